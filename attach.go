@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	docker "github.com/fsouza/go-dockerclient"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// attachContainer watches and relays logs for a container that is already
+// running, rather than launching one from a Mesos task. This is for debugging
+// health checks and log relaying against a live container. We never stop,
+// restart, or pause it, even when it fails its health checks.
+func (exec *sidecarExecutor) attachContainer(containerId string) error {
+	inspect, err := exec.client.InspectContainer(containerId)
+	if err != nil {
+		return fmt.Errorf("Unable to attach to container %s: %s", containerId, err)
+	}
+
+	if !inspect.State.Running {
+		return fmt.Errorf("Unable to attach to container %s: not running", containerId)
+	}
+
+	config := inspect.Config
+	if config == nil {
+		config = &docker.Config{}
+	}
+
+	exec.containerID = containerId
+	exec.health.update(func(s *healthState) { s.containerID = containerId })
+	exec.attached = true
+	exec.observeOnly = true
+	exec.containerConfig = &docker.CreateContainerOptions{
+		Name:       inspect.Name,
+		Config:     config,
+		HostConfig: inspect.HostConfig,
+	}
+
+	// There is no Mesos task, so we make one up for the status updates
+	taskInfo := &mesos.TaskInfo{
+		Name:   inspect.Name,
+		TaskID: mesos.TaskID{Value: "attached-" + containerId},
+	}
+
+	log.Infof("Attaching to running container %s", containerId)
+
+	exec.watchLooper = exec.newWatchLooper()
+	exec.watchContainer(exec.newTaskContext(), containerId, taskInfo, config.Labels)
+
+	return nil
+}
+
+// attachDriver stands in for the Mesos driver when we are attached to an
+// existing container. There's no agent to talk to, so status updates are
+// just logged.
+type attachDriver struct {
+	stopChan chan struct{}
+	stopOnce sync.Once
+}
+
+func newAttachDriver() *attachDriver {
+	return &attachDriver{stopChan: make(chan struct{})}
+}
+
+func (d *attachDriver) NewStatus(id mesos.TaskID) mesos.TaskStatus {
+	return mesos.TaskStatus{TaskID: id}
+}
+
+func (d *attachDriver) SendStatusUpdate(status mesos.TaskStatus) error {
+	fields := log.Fields{"TaskID": status.TaskID.Value, "State": status.State.String()}
+	if status.Message != nil {
+		fields["Message"] = *status.Message
+	}
+	log.WithFields(fields).Info("Task status update")
+	return nil
+}
+
+func (d *attachDriver) Stop() {
+	d.stopOnce.Do(func() { close(d.stopChan) })
+}
+
+// Run blocks until the driver is stopped.
+func (d *attachDriver) Run() error {
+	<-d.stopChan
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar-executor/container"
+	"github.com/Nitro/sidecar/service"
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_attachContainer(t *testing.T) {
+	Convey("attachContainer()", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		client := &container.MockDockerClient{
+			Container: &docker.Container{
+				Name: "grendel",
+				State: docker.State{
+					Running: true,
+				},
+				Config: &docker.Config{
+					Labels: map[string]string{"SidecarDiscover": "false"},
+				},
+			},
+		}
+
+		config, err := initConfig()
+		So(err, ShouldBeNil)
+
+		driver := newAttachDriver()
+		exec := newSidecarExecutor(client, &docker.AuthConfiguration{}, config)
+		exec.driver = driver
+		exec.statusSleepTime = 0
+
+		Convey("watches an existing container until it exits", func() {
+			var captured bytes.Buffer
+			log.SetOutput(&captured)
+
+			// The container has gone away by the time we check it, so the
+			// watcher should finish the task
+			client.ListContainersContainers = nil
+
+			err := exec.attachContainer("deadbeef0010")
+			So(err, ShouldBeNil)
+			So(exec.containerID, ShouldEqual, "deadbeef0010")
+			So(exec.attached, ShouldBeTrue)
+			So(shouldCheckSidecar(exec.containerConfig), ShouldBeFalse)
+
+			So(driver.Run(), ShouldBeNil)
+
+			So(client.ContainerStarted, ShouldBeFalse)
+			So(captured.String(), ShouldContainSubstring, "Attaching to running container deadbeef0010")
+			So(captured.String(), ShouldContainSubstring, "State=TASK_FINISHED")
+		})
+
+		Convey("never touches the container it is watching", func() {
+			var captured bytes.Buffer
+			log.SetOutput(&captured)
+
+			client.ListContainersContainers = []docker.APIContainers{
+				{ID: "deadbeef0010", State: "running"},
+			}
+
+			Convey("when we get a signal", func() {
+				err := exec.attachContainer("deadbeef0010")
+				So(err, ShouldBeNil)
+
+				// What handleSignals() does on Ctrl-C
+				exec.watchLooper.Done(errors.New("Got interrupt signal!"))
+				So(driver.Run(), ShouldBeNil)
+
+				So(client.StopContainerCalls, ShouldEqual, 0)
+				So(captured.String(), ShouldContainSubstring, "leaving it running")
+			})
+
+			Convey("doesn't run the post-stop command for it", func() {
+				exec.config.PostStopCommand = "echo $TASK_STATE"
+
+				err := exec.attachContainer("deadbeef0010")
+				So(err, ShouldBeNil)
+
+				exec.watchLooper.Done(errors.New("Got interrupt signal!"))
+				So(driver.Run(), ShouldBeNil)
+
+				So(captured.String(), ShouldNotContainSubstring, "Running post-stop command")
+				So(captured.String(), ShouldContainSubstring, "skipping the post-stop command")
+			})
+
+			Convey("when it fails its health checks", func() {
+				client.Container.Config.Labels["SidecarDiscover"] = "true"
+				exec.sidecar = &fakeSidecarClient{Status: service.UNHEALTHY}
+				exec.config.SidecarBackoff = 0
+				exec.config.SidecarPollInterval = time.Millisecond
+				exec.config.SidecarMaxFails = 1
+				exec.config.RestartOnUnhealthy = true
+				exec.config.OnUnhealthy = "pause"
+
+				err := exec.attachContainer("deadbeef0010")
+				So(err, ShouldBeNil)
+				So(driver.Run(), ShouldBeNil)
+
+				So(client.StopContainerCalls, ShouldEqual, 0)
+				So(client.ContainerPaused, ShouldBeFalse)
+				So(client.ContainerStarted, ShouldBeFalse)
+				So(captured.String(), ShouldContainSubstring, "State=TASK_FAILED")
+				So(captured.String(), ShouldContainSubstring, "leaving it running")
+			})
+		})
+
+		Convey("refuses to attach to a container that isn't running", func() {
+			client.Container.State.Running = false
+
+			err := exec.attachContainer("deadbeef0010")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not running")
+		})
+
+		Convey("returns an error when the container doesn't exist", func() {
+			client.InspectContainerShouldError = true
+
+			err := exec.attachContainer("deadbeef0010")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Unable to attach")
+		})
+	})
+}
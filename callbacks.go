@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/Nitro/sidecar-executor/container"
+	"github.com/Nitro/sidecar-executor/loghooks"
+	retry "github.com/avast/retry-go"
+	docker "github.com/fsouza/go-dockerclient"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
-	"github.com/relistan/go-director"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,16 +22,75 @@ func (exec *sidecarExecutor) LaunchTask(taskInfo *mesos.TaskInfo) {
 	taskID := taskInfo.GetTaskID()
 	log.Info("Task ID ", taskID.GetValue())
 
-	// We need to tell the scheduler that we started the task
-	exec.sendStatus(TaskRunning, &taskID)
+	dockerLabels := container.LabelsForTask(taskInfo)
+
+	// Everything that can make the task invalid is checked before we send any
+	// status, so the scheduler only ever sees TASK_ERROR for a bad config.
+
+	// The scheduler may have compressed and/or encoded the task data
+	taskInfo.Data, err = container.DecodeTaskData(taskInfo.Data)
+	if err != nil {
+		log.Errorf("Failed to decode task data: %s", err)
+		exec.errorTask(taskInfo, fmt.Sprintf("Failed to decode task data: %s", err))
+		return
+	}
+
+	// Catch a malformed task spec now, rather than later when it's confusing
+	_, err = container.ParseTaskData(taskInfo.Data)
+	if err != nil {
+		log.Error(err.Error())
+		exec.errorTask(taskInfo, err.Error())
+		return
+	}
+
+	// Only run the images we were told we may
+	image := taskInfo.Container.Docker.Image
+	if !imageAllowed(image, exec.config.ImageAllowlist) {
+		msg := fmt.Sprintf("Image '%s' doesn't match the image allowlist", image)
+		log.Error(msg)
+		exec.errorTask(taskInfo, msg)
+		return
+	}
+
+	// We can't ask Docker for a platform, so make sure we'll get the right one
+	err = container.CheckPlatform(exec.client, dockerLabels)
+	if err != nil {
+		log.Error(err.Error())
+		if errors.Is(err, container.ErrPlatformMismatch) {
+			exec.errorTask(taskInfo, err.Error())
+		} else {
+			exec.failTask(taskInfo, ReasonLaunchFailed)
+		}
+		return
+	}
+
+	// Put the container under the cgroup an external resource manager expects
+	cgroupParent, err := container.CgroupParentForTask(dockerLabels, exec.config.CgroupParent)
+	if err != nil {
+		log.Error(err.Error())
+		exec.errorTask(taskInfo, err.Error())
+		return
+	}
+
+	// We need to tell the scheduler that we started the task. Unless we were
+	// asked to wait until the container has been up for a while, or until it
+	// is accepting connections.
+	runningDelay := runningDelayForTask(dockerLabels)
+	readinessAddr := readinessAddrForTask(taskInfo, dockerLabels, exec.config.PortHostIP)
+	holdRunning := runningDelay > 0 || readinessAddr != ""
+	if !holdRunning {
+		exec.sendStatus(TaskRunning, &taskID)
+	}
 
 	// Pull our Docker container if required
+	pullStart := time.Now()
 	err = exec.maybePullContainer(taskInfo)
 	if err != nil {
 		log.Errorf("Failed to pull image: %s", err)
-		exec.failTask(taskInfo)
+		exec.failTask(taskInfo, ReasonLaunchFailed)
 		return
 	}
+	pullDuration := time.Since(pullStart)
 
 	// Additional environment variables we'll pass to the container
 	var addEnvVars []string
@@ -35,14 +99,12 @@ func (exec *sidecarExecutor) LaunchTask(taskInfo *mesos.TaskInfo) {
 		addEnvVars = exec.addSidecarSeeds(addEnvVars)
 	}
 
-	dockerLabels := container.LabelsForTask(taskInfo)
-
 	// Look up the AWS Role in Vault if we have one defined
 	if exec.config.AWSRole != "" {
 		addEnvVars, err = exec.AddAndMonitorVaultAWSKeys(addEnvVars, exec.config.AWSRole)
 		if err != nil {
 			log.Error(err.Error())
-			exec.failTask(taskInfo)
+			exec.failTask(taskInfo, ReasonLaunchFailed)
 			return
 		}
 
@@ -51,7 +113,7 @@ func (exec *sidecarExecutor) LaunchTask(taskInfo *mesos.TaskInfo) {
 			err = exec.SetVaultAWSTTL(exec.config.AWSRoleTTL)
 			if err != nil {
 				log.Error(err.Error())
-				exec.failTask(taskInfo)
+				exec.failTask(taskInfo, ReasonLaunchFailed)
 				return
 			}
 		}
@@ -65,81 +127,334 @@ func (exec *sidecarExecutor) LaunchTask(taskInfo *mesos.TaskInfo) {
 		taskInfo,
 		exec.config.ForceCpuLimit,
 		exec.config.ForceMemoryLimit,
+		exec.config.MemorySwapMultiplier,
+		exec.config.ForceDiskLimit,
 		exec.config.UseCpuShares,
 		addEnvVars,
 	)
 
+	// Let Docker clean up the container when it exits, if asked to
+	exec.containerConfig.HostConfig.AutoRemove = exec.config.AutoRemove
+
+	// Put the container under the cgroup an external resource manager expects
+	exec.containerConfig.HostConfig.CgroupParent = cgroupParent
+
+	// Publish the ports on the interface we were told to, if any
+	container.BindPortsToHostIP(exec.containerConfig.HostConfig.PortBindings, exec.config.PortHostIP)
+
+	// Keep the container's log files from filling the disk. This was already
+	// validated with the rest of the config.
+	exec.containerConfig.HostConfig.LogConfig, _ = container.JsonFileLogConfig(
+		exec.config.LogMaxSize, exec.config.LogMaxFile,
+	)
+
+	// Give Docker the same grace period we use, so that `docker stop` and
+	// daemon shutdowns don't kill the container any sooner than we would
+	exec.containerConfig.Config.StopTimeout = int(exec.config.KillTaskTimeout)
+
 	// Log out what we're starting up with
 	exec.logTaskEnv(taskInfo, dockerLabels, addEnvVars)
 
+	// Add any env vars read from files on the agent. These are often secrets,
+	// so we add them after logging the environment.
+	fileEnv, err := container.EnvFromFiles(dockerLabels)
+	if err != nil {
+		log.Error(err.Error())
+		exec.endTask(TaskFailed, taskInfo, ReasonLaunchFailed, err.Error())
+		return
+	}
+	exec.containerConfig.Config.Env = append(exec.containerConfig.Config.Env, fileEnv...)
+
 	// Try to decrypt any existing Vault encoded env.
 	decryptedEnv, err := exec.vault.DecryptAllEnv(exec.containerConfig.Config.Env)
 	if err != nil {
 		log.Error(err.Error())
-		exec.failTask(taskInfo)
+		exec.failTask(taskInfo, ReasonLaunchFailed)
 		return
 	}
 	exec.containerConfig.Config.Env = decryptedEnv
 
-	// create the container
-	cntnr, err := exec.client.CreateContainer(*exec.containerConfig)
-	if err != nil {
-		log.Errorf("Failed to create Docker container: %s", err)
-		exec.failTask(taskInfo)
-		return
+	// Dump exactly what we're about to create, for troubleshooting
+	exec.logContainerConfig(exec.containerConfig)
+
+	// Create and start the container, retrying on Docker errors. Unless it's
+	// already running, in which case we just take it over.
+	containerStart := time.Now()
+	cntnr := exec.findRunningContainer(exec.containerConfig.Name)
+	if cntnr == nil {
+		cntnr, err = exec.launchContainer(taskInfo)
+		if err != nil {
+			log.Error(err.Error())
+			exec.failTask(taskInfo, ReasonLaunchFailed)
+			return
+		}
 	}
 
 	// Cache the container ID
 	exec.containerID = cntnr.ID
+	exec.health.update(func(s *healthState) { s.containerID = cntnr.ID })
 
-	// Start the container
-	log.Info("Starting container with ID " + cntnr.ID[:12])
-	err = exec.client.StartContainer(cntnr.ID, nil)
-	if err != nil {
-		log.Errorf("Failed to start Docker container: %s", err)
-		exec.failTask(taskInfo)
-		return
-	}
+	// Deploy latency matters, so we report how long these took
+	log.WithFields(log.Fields{
+		"PullDuration":  pullDuration.String(),
+		"StartDuration": time.Since(containerStart).String(),
+	}).Info("Container started")
 
 	// For debugging, set process title to contain container ID & image
 	SetProcessName("sidecar-executor " + cntnr.ID[:12] + " (" + taskInfo.Container.Docker.Image + ")")
 
-	exec.watchLooper = director.NewImmediateTimedLooper(
-		director.FOREVER,
-		exec.config.SidecarPollInterval,
-		make(chan error),
+	exec.watchLooper = exec.newWatchLooper()
+	ctx := exec.newTaskContext()
+
+	// Batch jobs may have a hard deadline, after which we kill them off
+	if maxRuntime := maxRuntimeForTask(dockerLabels); maxRuntime > 0 {
+		log.Infof("Task will be killed if it runs for longer than %s", maxRuntime)
+		exec.deadlineTimer = time.AfterFunc(maxRuntime, func() {
+			log.Warnf("Task exceeded its max runtime of %s", maxRuntime)
+			exec.watchLooper.Done(errDeadlineExceeded)
+		})
+	}
+
+	if holdRunning {
+		go exec.confirmRunning(ctx, cntnr.ID, &taskID, runningDelay, readinessAddr)
+	}
+
+	exec.watchContainer(ctx, cntnr.ID, taskInfo, dockerLabels)
+
+	log.Info("Launched Sidecar tasks... ready for Mesos instructions")
+}
+
+// findRunningContainer looks for an already running container for the task.
+// Container names are derived from the task ID, so if the executor was
+// restarted and the task relaunched, we'll find the container we started
+// last time. Adopting it avoids creating a duplicate.
+func (exec *sidecarExecutor) findRunningContainer(name string) *docker.Container {
+	cntnr, err := exec.client.InspectContainer(name)
+	if err != nil || cntnr == nil || !cntnr.State.Running {
+		return nil
+	}
+
+	log.Warnf("Container %s for this task is already running, adopting it", cntnr.ID[:12])
+	exec.attached = true
+	return cntnr
+}
+
+// launchContainer creates and starts the container, retrying up to
+// LaunchRetryCount times with a backoff starting at LaunchRetryDelay. Returns
+// the error from the last attempt if they all fail.
+func (exec *sidecarExecutor) launchContainer(taskInfo *mesos.TaskInfo) (*docker.Container, error) {
+	attempts := uint(exec.config.LaunchRetryCount + 1)
+
+	var (
+		cntnr   *docker.Container
+		lastErr error
+		attempt uint
 	)
 
-	// We have to do this in a different goroutine or the scheduler
-	// can't send us any further updates.
-	go exec.monitorTask(
-		cntnr.ID, taskInfo, shouldCheckSidecar(exec.containerConfig),
+	_ = retry.Do(func() error {
+		attempt += 1
+
+		cntnr, lastErr = exec.tryLaunchContainer(taskInfo)
+		if lastErr != nil && attempt < attempts {
+			// The delay doubles after each attempt
+			delay := exec.config.LaunchRetryDelay << (attempt - 1)
+			loghooks.LogRetry("launch", int(attempt), int(attempts), delay, lastErr)
+		}
+
+		return lastErr
+	},
+		retry.Attempts(attempts),
+		retry.Delay(exec.config.LaunchRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
 	)
 
-	// We may be responsible for log relaying. Handle, if we are.
-	exec.handleContainerLogs(cntnr.ID, dockerLabels)
+	return cntnr, lastErr
+}
 
-	log.Info("Launched Sidecar tasks... ready for Mesos instructions")
+// tryLaunchContainer makes one attempt at creating, connecting, and starting
+// the container. On failure it removes whatever it created, so that the next
+// attempt doesn't conflict with it.
+func (exec *sidecarExecutor) tryLaunchContainer(taskInfo *mesos.TaskInfo) (*docker.Container, error) {
+	cntnr, err := exec.client.CreateContainer(*exec.containerConfig)
+	if err != nil {
+		// A create that timed out may still have left a container behind.
+		// Usually there's nothing to remove, so we ignore the error.
+		_ = container.RemoveContainer(exec.client, exec.containerConfig.Name)
+
+		if storageOpt := exec.containerConfig.HostConfig.StorageOpt; storageOpt != nil {
+			err = container.StorageOptError(err, storageOpt)
+		}
+		return nil, fmt.Errorf("Failed to create Docker container: %s", err)
+	}
+
+	// Attach the container to any additional networks
+	err = container.ConnectNetworks(exec.client, cntnr.ID, container.NetworksForTask(taskInfo))
+	if err != nil {
+		exec.removeContainer(cntnr.ID)
+		return nil, fmt.Errorf("Failed to connect Docker container to networks: %s", err)
+	}
+
+	log.Info("Starting container with ID " + cntnr.ID[:12])
+	err = exec.client.StartContainer(cntnr.ID, nil)
+	if err != nil {
+		exec.removeContainer(cntnr.ID)
+		return nil, fmt.Errorf("Failed to start Docker container: %s", err)
+	}
+
+	return cntnr, nil
+}
+
+// removeContainer cleans up a container that we failed to launch
+func (exec *sidecarExecutor) removeContainer(containerId string) {
+	err := container.RemoveContainer(exec.client, containerId)
+	if err != nil {
+		log.Errorf("Failed to remove Docker container: %s", err)
+	}
 }
 
 // KillTask is a Mesos callback that will try very hard to kill off a running
 // task/container.
 func (exec *sidecarExecutor) KillTask(taskID *mesos.TaskID) {
 	log.Infof("Killing task: %s", taskID.Value)
+	exec.killRequested = true
+
+	// Draining can take a while, so let Mesos know we're working on it
+	exec.sendStatus(TaskKilling, taskID)
 
 	// Instruct Sidecar to set the status of the service to DRAINING
 	exec.notifyDrain()
 
+	// Don't block the driver while we wait out the grace period
+	if exec.config.KillGracePeriod > 0 {
+		log.Infof("Waiting %s before stopping the container", exec.config.KillGracePeriod)
+		time.AfterFunc(exec.config.KillGracePeriod, func() { exec.stopKilledTask(taskID) })
+		return
+	}
+
+	exec.stopKilledTask(taskID)
+}
+
+// stopKilledTask stops the container for a task that Mesos asked us to kill,
+// and stops watching it, which reports the final task status
+func (exec *sidecarExecutor) stopKilledTask(taskID *mesos.TaskID) {
 	containerName := container.GetContainerName(taskID)
 
 	// Stop the container ourselves
+	exec.stopTaskContainer(containerName)
+
+	// Stop watching the container and report appropriate task status
+	exec.stopWatching()
+}
+
+// FrameworkMessage is a Mesos callback that is invoked when the scheduler
+// sends us an arbitrary message.
+func (exec *sidecarExecutor) FrameworkMessage(data []byte) {
+	message := strings.TrimSpace(string(data))
+
+	switch message {
+	case "drain":
+		// Don't block the driver while we're draining. The container ID is
+		// read here, on the driver's goroutine, where LaunchTask set it.
+		go exec.drainTask(exec.containerID)
+	default:
+		log.Warnf("Ignoring unknown framework message: '%s'", message)
+	}
+}
+
+// drainTask puts the executor into drain mode, where health check failures are
+// no longer fatal. It then deregisters the service from Sidecar, waits for
+// in-flight requests to complete, and stops the container.
+func (exec *sidecarExecutor) drainTask(containerId string) {
+	if containerId == "" {
+		log.Error("Asked to drain, but no container has been started")
+		return
+	}
+
+	if !exec.startDraining() {
+		log.Warn("Already draining, ignoring drain request")
+		return
+	}
+
+	log.Warnf("Draining container %s", containerId[:12])
+	exec.health.update(func(s *healthState) { s.draining = true })
+
+	// Instruct Sidecar to set the status of the service to DRAINING
+	exec.notifyDrain()
+
+	log.Infof("Waiting %s for in-flight requests to complete", exec.config.DrainQuietPeriod)
+	time.Sleep(exec.config.DrainQuietPeriod)
+
+	exec.stopTaskContainer(containerId)
+
+	// Stop watching the container and report appropriate task status
+	exec.stopWatching()
+}
+
+// startDraining switches the executor into drain mode. It returns false if
+// we were already draining, so that only one drain ever proceeds.
+func (exec *sidecarExecutor) startDraining() bool {
+	exec.drainLock.Lock()
+	defer exec.drainLock.Unlock()
+
+	if exec.draining {
+		return false
+	}
+	exec.draining = true
+	return true
+}
+
+// isDraining reports whether we've started draining
+func (exec *sidecarExecutor) isDraining() bool {
+	exec.drainLock.Lock()
+	defer exec.drainLock.Unlock()
+
+	return exec.draining
+}
+
+// stopTaskContainer stops the container, giving it KillTaskTimeout to exit
+// after SIGTERM. If it doesn't, Docker kills it, and we make a note of that so
+// it can be reported with the final task status. If even that fails, we may
+// escalate to force removing it.
+func (exec *sidecarExecutor) stopTaskContainer(containerId string) {
+	if exec.observeOnly {
+		log.Infof("Only watching container %s, not stopping it", containerId)
+		return
+	}
+
+	exec.unpauseContainer(containerId)
+
+	stopStart := time.Now()
+
 	err := container.StopContainer(
-		exec.client, containerName, exec.config.KillTaskTimeout,
+		exec.client, containerId, exec.config.KillTaskTimeout,
 	)
 	if err != nil {
-		log.Errorf("Error stopping container %s! %s", containerName, err.Error())
+		log.Errorf("Error stopping container %s! %s", containerId, err.Error())
+		exec.forceRemoveStuck(containerId)
+		return
 	}
 
-	// Stop watching the container and report appropriate task status
-	exec.watchLooper.Quit()
+	if container.WasHardKilled(exec.client, containerId) {
+		log.Warnf("Container %s ignored SIGTERM and was killed after %s",
+			containerId, time.Since(stopStart))
+		exec.hardKilled = true
+	}
+}
+
+// forceRemoveStuck removes a container that we couldn't stop, when configured
+// to with ForceRemoveStuck.
+func (exec *sidecarExecutor) forceRemoveStuck(containerId string) {
+	if !exec.config.ForceRemoveStuck {
+		return
+	}
+
+	log.Warnf("Container %s is stuck, force removing it", containerId)
+
+	err := container.RemoveContainer(exec.client, containerId)
+	if err != nil {
+		log.Errorf("Failed to force remove container %s! %s", containerId, err)
+		return
+	}
+
+	exec.forceRemoved = true
 }
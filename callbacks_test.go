@@ -2,10 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -53,6 +55,7 @@ func Test_shouldCheckSidecar(t *testing.T) {
 type mockMesosDriver struct {
 	sync.Mutex
 	receivedUpdate *mesos.TaskStatus
+	receivedStates []mesos.TaskState
 	isStopped      bool
 }
 
@@ -68,6 +71,7 @@ func (d *mockMesosDriver) NewStatus(id mesos.TaskID) mesos.TaskStatus {
 func (d *mockMesosDriver) SendStatusUpdate(status mesos.TaskStatus) error {
 	d.Lock()
 	d.receivedUpdate = &status
+	d.receivedStates = append(d.receivedStates, *status.State)
 	d.Unlock()
 	return nil
 }
@@ -287,6 +291,7 @@ func Test_ExecutorCallbacks(t *testing.T) {
 			containerID: dummyContainerId,
 			vault:       &dummyVault,
 			driver:      &mockDriver,
+			healthyChan: make(chan struct{}),
 		}
 
 		dummyContainerLabels := map[string]string{
@@ -339,6 +344,199 @@ func Test_ExecutorCallbacks(t *testing.T) {
 				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_RUNNING.Enum())
 			})
 
+			Convey("sets the container's stop timeout to the kill timeout", func() {
+				exec.config.KillTaskTimeout = 17
+				exec.LaunchTask(&taskInfo)
+
+				So(exec.containerConfig.Config.StopTimeout, ShouldEqual, 17)
+			})
+
+			Convey("sets the cgroup parent from the label", func() {
+				exec.config.CgroupParent = "/mesos"
+				dummyContainerLabels["CgroupParent"] = "/mesos/tasks"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				exec.LaunchTask(&taskInfo)
+
+				So(exec.containerConfig.HostConfig.CgroupParent, ShouldEqual, "/mesos/tasks")
+			})
+
+			Convey("publishes the ports on the configured host IP", func() {
+				exec.config.PortHostIP = "10.3.5.8"
+				exec.LaunchTask(&taskInfo)
+
+				bindings := exec.containerConfig.HostConfig.PortBindings
+				So(bindings, ShouldNotBeEmpty)
+				for _, binds := range bindings {
+					So(binds[0].HostIP, ShouldEqual, "10.3.5.8")
+				}
+			})
+
+			Convey("caps the size of the container's log files", func() {
+				exec.config.LogMaxSize = "10m"
+				exec.config.LogMaxFile = 3
+				exec.LaunchTask(&taskInfo)
+
+				So(exec.containerConfig.HostConfig.LogConfig.Type, ShouldEqual, "json-file")
+				So(exec.containerConfig.HostConfig.LogConfig.Config, ShouldResemble,
+					map[string]string{"max-size": "10m", "max-file": "3"})
+			})
+
+			Convey("fails the task when the cgroup parent is invalid", func() {
+				dummyContainerLabels["CgroupParent"] = "../../etc"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				exec.LaunchTask(&taskInfo)
+
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_ERROR.Enum())
+				So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{mesos.TASK_ERROR})
+				So(*mockDriver.receivedUpdate.Message, ShouldStartWith, "invalid-config: Invalid cgroup parent")
+			})
+
+			Convey("sends TASK_ERROR for a platform the daemon doesn't run", func() {
+				dummyDockerClient.DaemonPlatform = "linux/amd64"
+				dummyContainerLabels["Platform"] = "linux/arm64"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				exec.LaunchTask(&taskInfo)
+
+				So(dummyDockerClient.PullImageRetries, ShouldEqual, 0)
+				So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_ERROR.Enum())
+				So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{mesos.TASK_ERROR})
+				So(*mockDriver.receivedUpdate.Message, ShouldContainSubstring, "task wants linux/arm64")
+			})
+
+			Convey("launches an image that matches the allowlist", func() {
+				exec.config.ImageAllowlist = []string{"nitro/*", "foobar:*"}
+				exec.LaunchTask(&taskInfo)
+
+				So(dummyDockerClient.ContainerStarted, ShouldBeTrue)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_RUNNING.Enum())
+			})
+
+			Convey("sends TASK_ERROR for an image that isn't in the allowlist", func() {
+				exec.config.ImageAllowlist = []string{"nitro/*"}
+				exec.LaunchTask(&taskInfo)
+
+				So(mockDriver.isStopped, ShouldBeTrue)
+				So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_ERROR.Enum())
+				So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{mesos.TASK_ERROR})
+				So(*mockDriver.receivedUpdate.Message, ShouldContainSubstring,
+					"Image 'foobar:666' doesn't match the image allowlist")
+			})
+
+			Convey("launches a task that has no Command", func() {
+				taskInfo.Command = nil
+				exec.LaunchTask(&taskInfo)
+
+				So(dummyDockerClient.ContainerStarted, ShouldBeTrue)
+				So(exec.containerConfig.Config.Cmd, ShouldBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_RUNNING.Enum())
+			})
+
+			Convey("Delays TASK_RUNNING when executor.RunningDelay is set", func() {
+				dummyContainerLabels["executor.RunningDelay"] = "20ms"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+
+				exec.LaunchTask(&taskInfo)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldBeNil)
+				mockDriver.Unlock()
+
+				time.Sleep(50 * time.Millisecond)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_RUNNING.Enum())
+				mockDriver.Unlock()
+			})
+
+			Convey("Suppresses TASK_RUNNING when the container dies within the delay", func() {
+				dummyContainerLabels["executor.RunningDelay"] = "20ms"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				dummyDockerClient.ListContainersContainers = nil
+
+				exec.LaunchTask(&taskInfo)
+
+				// Give both the watcher and the delay time to complete
+				time.Sleep(50 * time.Millisecond)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FINISHED.Enum())
+				mockDriver.Unlock()
+			})
+
+			Convey("Logs the image pull and container start durations", func() {
+				var capture bytes.Buffer
+				log.SetLevel(log.InfoLevel)
+				log.SetOutput(&capture)
+
+				exec.LaunchTask(&taskInfo)
+
+				log.SetOutput(ioutil.Discard)
+
+				So(capture.String(), ShouldContainSubstring, "Container started")
+				So(capture.String(), ShouldContainSubstring, "PullDuration=")
+				So(capture.String(), ShouldContainSubstring, "StartDuration=")
+			})
+
+			Convey("Fails the task when the container never becomes ready", func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				_, port, _ := net.SplitHostPort(listener.Addr().String())
+				listener.Close()
+
+				dummyContainerLabels["executor.ReadinessPort"] = port
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				exec.config.ReadinessTimeout = 10 * time.Millisecond
+
+				exec.LaunchTask(&taskInfo)
+
+				// Give the probe and the watcher time to complete
+				time.Sleep(50 * time.Millisecond)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FAILED.Enum())
+				So(mockDriver.isStopped, ShouldBeTrue)
+				mockDriver.Unlock()
+			})
+
+			Convey("Kills the task when it exceeds MaxRuntime", func() {
+				dummyContainerLabels["MaxRuntime"] = "10ms"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+
+				exec.LaunchTask(&taskInfo)
+
+				// Give the deadline and the watcher time to complete
+				time.Sleep(50 * time.Millisecond)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_KILLED.Enum())
+				So(*mockDriver.receivedUpdate.Message, ShouldEqual, "deadline exceeded")
+				So(mockDriver.isStopped, ShouldBeTrue)
+				mockDriver.Unlock()
+			})
+
+			Convey("Cancels the deadline when the task completes first", func() {
+				dummyContainerLabels["MaxRuntime"] = "20ms"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				dummyDockerClient.ListContainersContainers = nil
+
+				exec.LaunchTask(&taskInfo)
+
+				// Wait past the deadline
+				time.Sleep(50 * time.Millisecond)
+
+				mockDriver.Lock()
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FINISHED.Enum())
+				mockDriver.Unlock()
+				So(exec.deadlineTimer.Stop(), ShouldBeFalse) // Already stopped
+			})
+
 			Convey("Seeds sidecar", func() {
 				exec.config.SeedSidecar = true
 				err := os.Setenv("MESOS_AGENT_ENDPOINT", fakeServer.Listener.Addr().String())
@@ -522,6 +720,36 @@ func Test_ExecutorCallbacks(t *testing.T) {
 				})
 			})
 
+			Convey("sends TASK_ERROR for an invalid task spec", func() {
+				taskInfo.Data = []byte(`{"Env": {"NOT A NAME": "grendel"}}`)
+				exec.LaunchTask(&taskInfo)
+
+				So(mockDriver.isStopped, ShouldBeTrue)
+				So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_ERROR.Enum())
+				So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{mesos.TASK_ERROR})
+				So(*mockDriver.receivedUpdate.Message, ShouldContainSubstring, "Invalid task data")
+			})
+
+			Convey("fails when a required env var file is missing", func() {
+				dummyContainerLabels["executor.EnvFile.GRENDEL"] = "/nonexistent/grendel,required"
+				taskInfo.Container.Docker.Parameters = labelsToDockerParams(dummyContainerLabels)
+				exec.LaunchTask(&taskInfo)
+
+				So(mockDriver.isStopped, ShouldBeTrue)
+				So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+				So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FAILED.Enum())
+				So(*mockDriver.receivedUpdate.Message, ShouldContainSubstring, "GRENDEL")
+			})
+
+			Convey("lets Docker remove the container when AutoRemove is set", func() {
+				exec.config.AutoRemove = true
+				exec.LaunchTask(&taskInfo)
+
+				So(exec.containerConfig.HostConfig.AutoRemove, ShouldBeTrue)
+				So(exec.exitChan, ShouldNotBeNil)
+			})
+
 			// TODO: test exec.handleContainerLogs
 
 			Convey("checks the container health via Sidecar", func() {
@@ -535,7 +763,71 @@ func Test_ExecutorCallbacks(t *testing.T) {
 				So(sidecarStateCalls, ShouldEqual, 1)
 			})
 
+			Convey("adopts the task's container when it's already running", func() {
+				dummyDockerClient.Container.ID = expectedContainerId
+				dummyDockerClient.Container.State = docker.State{Status: "running", Running: true}
+				exec.LaunchTask(&taskInfo)
+				exec.watchLooper.Quit()
+				So(exec.watchLooper.Wait(), ShouldBeNil)
+
+				So(dummyDockerClient.CreateContainerCalls, ShouldEqual, 0)
+				So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+				So(exec.containerID, ShouldEqual, expectedContainerId)
+				So(exec.attached, ShouldBeTrue)
+			})
+
+			Convey("retries creating the container, cleaning up in between", func() {
+				exec.config.LaunchRetryCount = 2
+				exec.config.LaunchRetryDelay = time.Millisecond
+				dummyDockerClient.CreateContainerFailures = 2
+				exec.LaunchTask(&taskInfo)
+
+				So(dummyDockerClient.CreateContainerCalls, ShouldEqual, 3)
+				So(dummyDockerClient.RemoveContainerCalls, ShouldEqual, 2)
+				So(dummyDockerClient.ContainerStarted, ShouldBeTrue)
+				So(exec.containerID, ShouldEqual, expectedContainerId)
+			})
+
 			Convey("fails to launch a task", func() {
+				Convey("when it keeps failing to create the container", func() {
+					exec.config.LaunchRetryCount = 1
+					exec.config.LaunchRetryDelay = time.Millisecond
+					dummyDockerClient.CreateContainerFailures = 2
+					exec.LaunchTask(&taskInfo)
+
+					So(dummyDockerClient.CreateContainerCalls, ShouldEqual, 2)
+					So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+					So(mockDriver.isStopped, ShouldBeTrue)
+					So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FAILED.Enum())
+				})
+
+				Convey("when it fails to connect to a network", func() {
+					taskInfo.Container.Docker.Parameters = append(
+						taskInfo.Container.Docker.Parameters,
+						mesos.Parameter{Key: "network", Value: "mesh"},
+					)
+					dummyDockerClient.ConnectNetworkShouldError = true
+					exec.LaunchTask(&taskInfo)
+
+					So(mockDriver.isStopped, ShouldBeTrue)
+					So(dummyDockerClient.ContainerRemoved, ShouldBeTrue)
+					So(dummyDockerClient.ContainerStarted, ShouldBeFalse)
+					So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FAILED.Enum())
+				})
+
+				Convey("and removes the container even with AutoRemove, since it never started", func() {
+					taskInfo.Container.Docker.Parameters = append(
+						taskInfo.Container.Docker.Parameters,
+						mesos.Parameter{Key: "network", Value: "mesh"},
+					)
+					dummyDockerClient.ConnectNetworkShouldError = true
+					exec.config.AutoRemove = true
+					exec.LaunchTask(&taskInfo)
+
+					So(dummyDockerClient.ContainerRemoved, ShouldBeTrue)
+					So(*mockDriver.receivedUpdate.State, ShouldEqual, *mesos.TASK_FAILED.Enum())
+				})
+
 				Convey("when it fails to pull an image", func() {
 					dummyDockerClient.PullImageShouldError = true
 					exec.LaunchTask(&taskInfo)
@@ -567,7 +859,7 @@ func Test_ExecutorCallbacks(t *testing.T) {
 			exec.watchLooper = director.NewFreeLooper(1, make(chan error))
 
 			Convey("when draining the service", func() {
-				go exec.monitorTask(dummyContainerId, &taskInfo, true)
+				go exec.monitorTask(context.Background(), dummyContainerId, &taskInfo, true)
 				exec.KillTask(&dummyTaskID)
 				So(sidecarDrainCalls, ShouldEqual, 1)
 
@@ -577,7 +869,13 @@ func Test_ExecutorCallbacks(t *testing.T) {
 					So(mockDriver.receivedUpdate.TaskID.Value, ShouldNotBeNil)
 					So(mockDriver.receivedUpdate.TaskID.Value, ShouldEqual, dummyTaskIDValue)
 					So(mockDriver.receivedUpdate.State, ShouldNotBeNil)
-					So(mockDriver.receivedUpdate.State, ShouldResemble, mesos.TASK_FINISHED.Enum())
+					So(mockDriver.receivedUpdate.State, ShouldResemble, mesos.TASK_KILLED.Enum())
+				})
+
+				Convey("sends TASK_KILLING before TASK_KILLED", func() {
+					So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{
+						mesos.TASK_KILLING, mesos.TASK_KILLED,
+					})
 				})
 
 				Convey("stops the Mesos driver", func() {
@@ -585,6 +883,56 @@ func Test_ExecutorCallbacks(t *testing.T) {
 				})
 			})
 
+			Convey("waits out the kill grace period before stopping the container", func() {
+				exec.config.KillGracePeriod = 50 * time.Millisecond
+				exec.watchLooper = director.NewFreeLooper(director.FOREVER, make(chan error))
+				go exec.watchLooper.Loop(func() error { return nil })
+
+				start := time.Now()
+				exec.KillTask(&dummyTaskID)
+
+				// The driver callback doesn't wait for it
+				So(time.Since(start), ShouldBeLessThan, 50*time.Millisecond)
+				So(mockDriver.receivedStates, ShouldResemble, []mesos.TaskState{mesos.TASK_KILLING})
+
+				So(exec.watchLooper.Wait(), ShouldBeNil)
+				So(time.Since(start), ShouldBeGreaterThanOrEqualTo, 50*time.Millisecond)
+				So(dummyDockerClient.StopContainerCalls, ShouldEqual, 1)
+			})
+
+			Convey("reports when the container ignored SIGTERM and had to be killed", func() {
+				dummyDockerClient.Container.State.ExitCode = 137
+
+				go exec.monitorTask(context.Background(), dummyContainerId, &taskInfo, true)
+				exec.KillTask(&dummyTaskID)
+
+				So(exec.hardKilled, ShouldBeTrue)
+				So(mockDriver.receivedUpdate, ShouldNotBeNil)
+				So(mockDriver.receivedUpdate.State, ShouldResemble, mesos.TASK_KILLED.Enum())
+				So(*mockDriver.receivedUpdate.Message, ShouldContainSubstring, "ignored SIGTERM")
+			})
+
+			Convey("when the container is stuck", func() {
+				dummyDockerClient.Container.State.Status = "running"
+				dummyDockerClient.StopContainerShouldError = true
+
+				Convey("force removes it when configured to", func() {
+					exec.config.ForceRemoveStuck = true
+					exec.stopTaskContainer(dummyContainerId)
+
+					So(dummyDockerClient.RemoveContainerCalls, ShouldEqual, 1)
+					So(exec.forceRemoved, ShouldBeTrue)
+					So(exec.hardKillMessage(), ShouldContainSubstring, "force removed")
+				})
+
+				Convey("leaves it alone by default", func() {
+					exec.stopTaskContainer(dummyContainerId)
+
+					So(dummyDockerClient.RemoveContainerCalls, ShouldEqual, 0)
+					So(exec.forceRemoved, ShouldBeFalse)
+				})
+			})
+
 			Convey("notifies Sidecar to drain the service before stopping the watch looper", func() {
 				doneChan := make(chan error)
 				exec.watchLooper = director.NewFreeLooper(director.FOREVER, doneChan)
@@ -634,7 +982,7 @@ func Test_ExecutorCallbacks(t *testing.T) {
 
 			Convey("stops draining the service if the container exits prematurely", func() {
 				exec.config.SidecarDrainingDuration = 100 * time.Millisecond
-				go exec.monitorTask(dummyContainerId, &taskInfo,
+				go exec.monitorTask(context.Background(), dummyContainerId, &taskInfo,
 					shouldCheckSidecar(exec.containerConfig))
 
 				exec.KillTask(&dummyTaskID)
@@ -735,5 +1083,70 @@ func Test_ExecutorCallbacks(t *testing.T) {
 				So(capture.String(), ShouldContainSubstring, "Intentional test error")
 			})
 		})
+
+		Convey("FrameworkMessage()", func() {
+			dummyContainerLabels["SidecarDiscover"] = "true"
+			exec.containerConfig = &docker.CreateContainerOptions{
+				Config: &docker.Config{
+					Labels: dummyContainerLabels,
+				},
+			}
+
+			exec.watchLooper = director.NewFreeLooper(director.FOREVER, make(chan error))
+			go exec.watchLooper.Loop(func() error { return nil })
+
+			Convey("transitions to drain mode and stops the task on 'drain'", func() {
+				So(exec.draining, ShouldBeFalse)
+
+				exec.drainTask(dummyContainerId)
+
+				So(exec.draining, ShouldBeTrue)
+				So(sidecarDrainCalls, ShouldEqual, 1)
+				So(exec.watchLooper.Wait(), ShouldBeNil)
+			})
+
+			Convey("ignores health check failures while draining", func() {
+				exec.draining = true
+				exec.failCount = exec.config.SidecarMaxFails
+
+				fetcher := &mockFetcher{ShouldFail: true}
+				exec.fetcher = fetcher
+				os.Setenv("TASK_HOST", "roncevalles")
+
+				So(exec.sidecarStatus("deadbeef0010"), ShouldBeNil)
+				exec.watchLooper.Quit()
+			})
+
+			Convey("only drains once", func() {
+				var wg sync.WaitGroup
+				for i := 0; i < 2; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						exec.drainTask(dummyContainerId)
+					}()
+				}
+				wg.Wait()
+
+				So(exec.isDraining(), ShouldBeTrue)
+				So(sidecarDrainCalls, ShouldEqual, 1)
+				So(exec.watchLooper.Wait(), ShouldBeNil)
+			})
+
+			Convey("doesn't drain when no container has been started", func() {
+				exec.drainTask("")
+
+				So(exec.isDraining(), ShouldBeFalse)
+				So(sidecarDrainCalls, ShouldEqual, 0)
+				exec.watchLooper.Quit()
+			})
+
+			Convey("ignores unknown messages", func() {
+				exec.FrameworkMessage([]byte("beowulf"))
+
+				So(exec.draining, ShouldBeFalse)
+				exec.watchLooper.Quit()
+			})
+		})
 	})
 }
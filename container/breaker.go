@@ -0,0 +1,113 @@
+package container
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long the breaker stays open before we try Docker again
+	BreakerCooldown = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned without calling Docker when too many recent
+// calls have timed out.
+var ErrCircuitOpen = errors.New("Docker daemon appears unresponsive, circuit breaker is open")
+
+// BreakerClient wraps a DockerClient so that the calls we make while watching
+// a container can't hang forever on a degraded daemon. Calls that take longer
+// than the timeout return an error, and after enough consecutive timeouts we
+// stop calling Docker at all until the cooldown has passed. Other calls are
+// passed straight through.
+type BreakerClient struct {
+	DockerClient
+	Timeout     time.Duration
+	MaxFailures int
+	Cooldown    time.Duration
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+// NewBreakerClient returns a BreakerClient wrapping the client, with the
+// default cooldown.
+func NewBreakerClient(client DockerClient, timeout time.Duration, maxFailures int) *BreakerClient {
+	return &BreakerClient{
+		DockerClient: client,
+		Timeout:      timeout,
+		MaxFailures:  maxFailures,
+		Cooldown:     BreakerCooldown,
+	}
+}
+
+func (b *BreakerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
+	var containers []docker.APIContainers
+	err := b.call("ListContainers", func() error {
+		var err error
+		containers, err = b.DockerClient.ListContainers(opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return containers, nil
+}
+
+func (b *BreakerClient) InspectContainer(id string) (*docker.Container, error) {
+	var cntnr *docker.Container
+	err := b.call("InspectContainer", func() error {
+		var err error
+		cntnr, err = b.DockerClient.InspectContainer(id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cntnr, nil
+}
+
+// call runs fn with the timeout, unless the breaker is open. The Docker client
+// doesn't let us cancel the request, so on timeout fn is left to finish on
+// its own, and its results are discarded.
+func (b *BreakerClient) call(name string, fn func() error) error {
+	b.lock.Lock()
+	if time.Now().Before(b.openUntil) {
+		b.lock.Unlock()
+		return ErrCircuitOpen
+	}
+	b.lock.Unlock()
+
+	done := make(chan error, 1) // Buffered so a late fn doesn't block forever
+	go func() { done <- fn() }()
+
+	select {
+	case err := <-done:
+		// Any answer at all means the daemon is responsive
+		b.lock.Lock()
+		b.failures = 0
+		b.lock.Unlock()
+		return err
+	case <-time.After(b.Timeout):
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures += 1
+	if b.failures >= b.MaxFailures {
+		log.Errorf("Docker %s timed out %d times in a row, not calling Docker for %s",
+			name, b.failures, b.Cooldown)
+		b.openUntil = time.Now().Add(b.Cooldown)
+		b.failures = 0
+	}
+
+	return fmt.Errorf("Docker %s timed out after %s", name, b.Timeout)
+}
@@ -0,0 +1,69 @@
+package container
+
+import (
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_BreakerClient(t *testing.T) {
+	Convey("BreakerClient", t, func() {
+		dockerClient := &MockDockerClient{
+			ListContainersContainers: []docker.APIContainers{
+				{ID: "deadbeef0010", State: "running"},
+			},
+		}
+
+		client := NewBreakerClient(dockerClient, 10*time.Millisecond, 2)
+
+		Convey("passes through calls to a healthy daemon", func() {
+			containers, err := client.ListContainers(docker.ListContainersOptions{})
+
+			So(err, ShouldBeNil)
+			So(len(containers), ShouldEqual, 1)
+		})
+
+		Convey("times out calls to a slow daemon", func() {
+			dockerClient.ListContainersDelay = 50 * time.Millisecond
+
+			containers, err := client.ListContainers(docker.ListContainersOptions{})
+
+			So(containers, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "ListContainers timed out")
+		})
+
+		Convey("trips after repeated timeouts and short-circuits calls", func() {
+			dockerClient.ListContainersDelay = 50 * time.Millisecond
+
+			client.ListContainers(docker.ListContainersOptions{})
+			client.ListContainers(docker.ListContainersOptions{})
+
+			// Now we don't even wait for Docker
+			start := time.Now()
+			_, err := client.ListContainers(docker.ListContainersOptions{})
+
+			So(err, ShouldEqual, ErrCircuitOpen)
+			So(time.Since(start), ShouldBeLessThan, 10*time.Millisecond)
+
+			_, err = client.InspectContainer("deadbeef0010")
+			So(err, ShouldEqual, ErrCircuitOpen)
+		})
+
+		Convey("tries Docker again after the cooldown", func() {
+			client.Cooldown = 20 * time.Millisecond
+			dockerClient.ListContainersDelay = 50 * time.Millisecond
+
+			client.ListContainers(docker.ListContainersOptions{})
+			client.ListContainers(docker.ListContainersOptions{})
+
+			time.Sleep(30 * time.Millisecond)
+
+			_, err := client.ListContainers(docker.ListContainersOptions{})
+			So(err, ShouldNotEqual, ErrCircuitOpen)
+			So(err.Error(), ShouldContainSubstring, "timed out")
+		})
+	})
+}
@@ -1,15 +1,30 @@
 package container
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/Nitro/sidecar-executor/loghooks"
 	retry "github.com/avast/retry-go"
+	units "github.com/docker/go-units"
 	docker "github.com/fsouza/go-dockerclient"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
 	"github.com/pborman/uuid"
@@ -20,25 +35,54 @@ const (
 	// How many times a docker image pull will be retried on error
 	PullImageNumRetries = 5
 
+	// How long to wait before the first retry of a pull. This doubles each
+	// time.
+	PullImageRetryDelay = 100 * time.Millisecond
+
 	// Using a small period (50ms) to ensure a consistency latency response at the expense of burst capacity
 	// See: https://www.kernel.org/doc/Documentation/scheduler/sched-bwc.txt
 	defaultCpuPeriod = 50000 // 50ms
 )
 
+// ErrPullStalled is returned when an image pull made no progress for the
+// stall timeout
+var ErrPullStalled = errors.New("Image pull stalled")
+
+// ErrPlatformMismatch is returned when the task asked for a platform that the
+// Docker daemon doesn't run.
+var ErrPlatformMismatch = errors.New("Requested platform doesn't match the Docker daemon")
+
 var portProtocolsTokenizer = regexp.MustCompile(`,\s?`)
 
+// Matches the agent fact placeholders we can template into env vars
+var agentFactExpr = regexp.MustCompile(`\$\{AGENT_[A-Z_]+\}`)
+
 // Our own narrowly-scoped interface for Docker client
 type DockerClient interface {
+	ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error
+	ContainerChanges(id string) ([]docker.Change, error)
 	CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error)
 	InspectContainer(id string) (*docker.Container, error)
 	ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error)
 	ListImages(docker.ListImagesOptions) ([]docker.APIImages, error)
 	Logs(opts docker.LogsOptions) error
+	PauseContainer(id string) error
 	PullImage(docker.PullImageOptions, docker.AuthConfiguration) error
+	RemoveContainer(opts docker.RemoveContainerOptions) error
 	StartContainer(id string, hostConfig *docker.HostConfig) error
+	Stats(opts docker.StatsOptions) error
 	StopContainer(id string, timeout uint) error
+	UnpauseContainer(id string) error
+	Version() (*docker.Env, error)
+	WaitContainer(id string) (int, error)
 }
 
+// Make sure the real client, and our wrapper around it, stay compatible
+var (
+	_ DockerClient = (*docker.Client)(nil)
+	_ DockerClient = (*BreakerClient)(nil)
+)
+
 // Loop through all the images and see if we have one with a match
 // on this repo image:tag combination.
 func CheckImage(client DockerClient, taskInfo *mesos.TaskInfo) bool {
@@ -88,24 +132,98 @@ func StopContainer(client DockerClient, containerId string, timeout uint) error
 	return nil
 }
 
+// WasHardKilled reports whether the container was stopped with SIGKILL, which
+// is what Docker resorts to when it ignores SIGTERM until the stop timeout.
+// OOM kills are also a SIGKILL, but aren't counted.
+func WasHardKilled(client DockerClient, containerId string) bool {
+	inspect, err := client.InspectContainer(containerId)
+	if err != nil {
+		return false
+	}
+	return inspect.State.ExitCode == 137 && !inspect.State.OOMKilled
+}
+
+// ConnectNetworks attaches the container to each of the named networks, in
+// addition to the one it was created on. Each may be followed by DNS aliases
+// for the container on that network, e.g. "mesh:beowulf,geat".
+func ConnectNetworks(client DockerClient, containerId string, networks []string) error {
+	for _, value := range networks {
+		network, aliases := parseNetwork(value)
+
+		opts := docker.NetworkConnectionOptions{Container: containerId}
+		if len(aliases) > 0 {
+			log.Infof("Connecting container %s to network '%s' with aliases %v", containerId, network, aliases)
+			opts.EndpointConfig = &docker.EndpointConfig{Aliases: aliases}
+		} else {
+			log.Infof("Connecting container %s to network '%s'", containerId, network)
+		}
+
+		err := client.ConnectNetwork(network, opts)
+		if err != nil {
+			return fmt.Errorf("Unable to connect to network '%s': %s", network, err)
+		}
+	}
+
+	return nil
+}
+
+// RemoveContainer forcibly removes a container, along with its volumes. Used
+// to clean up after a container that we failed to get running.
+func RemoveContainer(client DockerClient, containerId string) error {
+	return client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:            containerId,
+		RemoveVolumes: true,
+		Force:         true,
+	})
+}
+
 // PullImage will pull the Docker image refered to in the taskInfo. Uses the Docker
-// credentials passed in.
-func PullImage(client DockerClient, taskInfo *mesos.TaskInfo, authConfig *docker.AuthConfiguration) error {
-	log.Infof("Pulling Docker image '%s'", taskInfo.Container.Docker.Image)
+// credentials passed in. With a stallTimeout, a pull that makes no progress
+// for that long is aborted with ErrPullStalled, and not retried.
+func PullImage(client DockerClient, taskInfo *mesos.TaskInfo, authConfig *docker.AuthConfiguration,
+	stallTimeout time.Duration) error {
+
+	// The go-dockerclient version we're pinned to doesn't support passing the
+	// platform to the pull, so Docker picks the daemon's own. CheckPlatform
+	// has already refused tasks that asked for anything else.
+	platform := PlatformForTask(LabelsForTask(taskInfo))
+	log.Infof("Pulling Docker image '%s' (platform %s)", taskInfo.Container.Docker.Image, platform)
 
 	var numRetries int
 
 	err := retry.Do(func() error {
 		numRetries = numRetries + 1
 
-		err := client.PullImage(
-			docker.PullImageOptions{
-				Repository: taskInfo.Container.Docker.Image,
-			},
-			*authConfig,
-		)
+		opts := docker.PullImageOptions{
+			Repository: taskInfo.Container.Docker.Image,
+		}
+
+		// Docker streams progress events while the pull is going
+		var watchdog *stallWriter
+		if stallTimeout > 0 {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			watchdog = newStallWriter(stallTimeout, cancel)
+			defer watchdog.Stop()
+
+			opts.Context = ctx
+			opts.OutputStream = watchdog
+			opts.RawJSONStream = true
+		}
+
+		err := client.PullImage(opts, *authConfig)
 		if err != nil {
-			log.Warnf("Pull failed (retry %d/%d): %s", numRetries, PullImageNumRetries, err)
+			if watchdog != nil && watchdog.Stalled() {
+				log.Errorf("Pull made no progress for %s, aborting", stallTimeout)
+				return fmt.Errorf("%w: no progress for %s", ErrPullStalled, stallTimeout)
+			}
+
+			if numRetries < PullImageNumRetries {
+				// The delay doubles after each attempt
+				delay := PullImageRetryDelay << uint(numRetries-1)
+				loghooks.LogRetry("pull", numRetries, PullImageNumRetries, delay, err)
+			}
 
 			return err
 		}
@@ -115,11 +233,50 @@ func PullImage(client DockerClient, taskInfo *mesos.TaskInfo, authConfig *docker
 		return nil
 	},
 		retry.Attempts(PullImageNumRetries),
+		retry.Delay(PullImageRetryDelay),
+		retry.DelayType(retry.BackOffDelay),
+		retry.RetryIf(func(err error) bool {
+			return !errors.Is(err, ErrPullStalled)
+		}),
 	)
 
 	return err
 }
 
+// stallWriter cancels the pull when nothing has been written to it for the
+// timeout. Docker writes each progress event to it, so a pull that's slow but
+// still making progress carries on.
+type stallWriter struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+func newStallWriter(timeout time.Duration, cancel context.CancelFunc) *stallWriter {
+	w := &stallWriter{timeout: timeout}
+	w.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		cancel()
+	})
+	return w
+}
+
+func (w *stallWriter) Write(p []byte) (int, error) {
+	if !w.Stalled() {
+		w.timer.Reset(w.timeout)
+	}
+	return len(p), nil
+}
+
+// Stalled reports whether the pull was cancelled for making no progress
+func (w *stallWriter) Stalled() bool {
+	return atomic.LoadInt32(&w.stalled) == 1
+}
+
+func (w *stallWriter) Stop() {
+	w.timer.Stop()
+}
+
 // GetLogs will fetch the Docker logs from a task and return two Readers that let
 // us fetch the contents.
 func GetLogs(client DockerClient, containerId string, since int64, stdout io.Writer, stderr io.Writer) {
@@ -139,59 +296,139 @@ func GetLogs(client DockerClient, containerId string, since int64, stdout io.Wri
 	}()
 }
 
-// FollowLogs will fetch the Docker logs since "since", and start pumping logs into
-// the two writers that are passed in.
-func FollowLogs(client DockerClient, containerId string, since int64, stdout io.Writer, stderr io.Writer) {
-	go func() {
-		err := client.Logs(docker.LogsOptions{
-			Container:    containerId,
-			OutputStream: stdout,
-			ErrorStream:  stderr,
-			Since:        since,
-			Stdout:       true,
-			Stderr:       true,
-			Follow:       true,
-		})
+// FollowLogs will fetch the Docker logs since "since", and pump logs into the
+// two writers that are passed in, until Docker stops sending them. Tail limits
+// how many existing lines are replayed, and may be "all". If either writer is
+// nil, we don't ask Docker for that stream at all.
+func FollowLogs(client DockerClient, containerId string, since int64, tail string, stdout io.Writer, stderr io.Writer) error {
+	wantStdout, wantStderr := stdout != nil, stderr != nil
+	if !wantStdout {
+		stdout = ioutil.Discard
+	}
+	if !wantStderr {
+		stderr = ioutil.Discard
+	}
 
-		if err != nil {
-			log.Errorf("Failed to fetch logs for task: %s", err.Error())
-		}
-	}()
+	err := client.Logs(docker.LogsOptions{
+		Container:    containerId,
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+		Since:        since,
+		Tail:         tail,
+		Stdout:       wantStdout,
+		Stderr:       wantStderr,
+		Follow:       true,
+	})
+
+	if err != nil {
+		log.Errorf("Failed to fetch logs for task: %s", err.Error())
+	}
+
+	return err
+}
+
+// CommandFromArguments builds the container command from the Arguments in the
+// Mesos CommandInfo, which may be nil. When Shell is false, the Arguments are
+// the argv passed to the image's entrypoint. Otherwise, they're appended to
+// the Value and run with "/bin/sh -c", replacing the image's entrypoint as
+// Mesos does. Without Arguments we return nothing, and the image's defaults
+// are used.
+func CommandFromArguments(command *mesos.CommandInfo) (entrypoint []string, cmd []string) {
+	if command == nil || len(command.Arguments) == 0 {
+		return nil, nil
+	}
+
+	if !command.GetShell() {
+		return nil, command.Arguments
+	}
+
+	words := make([]string, 0, len(command.Arguments)+1)
+	if command.GetValue() != "" {
+		words = append(words, command.GetValue())
+	}
+	for _, arg := range command.Arguments {
+		words = append(words, shellQuote(arg))
+	}
+
+	return []string{"/bin/sh", "-c"}, []string{strings.Join(words, " ")}
+}
+
+// shellQuote single quotes an argument so the shell passes it through as is
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
 }
 
 // Generate a complete config with both Config and HostConfig. Does not attempt
 // to be exhaustive in support for Docker options. Supports the most commonly
 // used options. Others are not complex to add.
-func ConfigForTask(taskInfo *mesos.TaskInfo, forceCpuLimit bool, forceMemoryLimit bool, useCpuShares bool, envVars []string) *docker.CreateContainerOptions {
+func ConfigForTask(taskInfo *mesos.TaskInfo, forceCpuLimit bool, forceMemoryLimit bool, memorySwapMultiplier float64,
+	forceDiskLimit bool, useCpuShares bool, envVars []string) *docker.CreateContainerOptions {
+
 	labels := LabelsForTask(taskInfo)
+	addSidecarLabels(labels, taskInfo)
+
+	// LaunchTask has already rejected an invalid spec
+	taskData, _ := ParseTaskData(taskInfo.Data)
 
-	var command []string
+	// The ShellCommand label wins over any Arguments in the Mesos CommandInfo.
+	// With neither, the image's own CMD is used.
+	var command, entrypoint []string
 	if _, ok := labels["executor.ShellCommand"]; ok {
 		command = strings.Split(labels["executor.ShellCommand"], " ")
 		delete(labels, "executor.ShellCommand")
+	} else {
+		entrypoint, command = CommandFromArguments(taskInfo.Command)
 	}
 
-	log.Infof("Launching task %s with command '%s'", taskInfo.GetName(), command)
+	if len(command) > 0 {
+		log.Infof("Launching task %s with command '%s'", taskInfo.GetName(), command)
+	} else {
+		log.Infof("Launching task %s with the image's default command", taskInfo.GetName())
+	}
 
 	config := &docker.CreateContainerOptions{
 		Name: GetContainerName(&taskInfo.TaskID),
 		Config: &docker.Config{
-			Env:          EnvForTask(taskInfo, labels, envVars),
+			Env: otelResourceAttributes(
+				append(
+					TemplateEnv(
+						append(EnvForTask(taskInfo, labels, envVars), taskData.EnvVars()...),
+						AgentFacts(taskInfo),
+					),
+					deployMetadataEnv(taskInfo)...,
+				),
+				labels,
+			),
 			ExposedPorts: PortsForTask(taskInfo),
 			Image:        taskInfo.Container.Docker.Image,
 			Labels:       labels,
 			Cmd:          command,
+			Entrypoint:   entrypoint,
 		},
 		HostConfig: &docker.HostConfig{
-			Binds:        BindsForTask(taskInfo),
+			Binds:        append(BindsForTask(taskInfo), taskData.Binds()...),
 			PortBindings: PortBindingsForTask(taskInfo),
 			NetworkMode:  NetworkForTask(taskInfo),
 			CapAdd:       CapAddForTask(taskInfo),
 			CapDrop:      CapDropForTask(taskInfo),
+			SecurityOpt:  SecurityOptForTask(taskInfo),
+			StorageOpt:   StorageOptForTask(taskInfo),
+			Tmpfs:        TmpfsForTask(taskInfo),
+			ShmSize:      ShmSizeForTask(labels),
+			PidMode:      PidModeForTask(taskInfo),
+			IpcMode:      IpcModeForTask(taskInfo),
+			UsernsMode:   UsernsModeForTask(taskInfo),
 			VolumeDriver: VolumeDriverForTask(taskInfo),
 		},
 	}
 
+	// An empty, rather than nil, entrypoint tells Docker not to use the
+	// image's ENTRYPOINT, so the command runs bare.
+	if clearEntrypoint, _ := strconv.ParseBool(labels["executor.ClearEntrypoint"]); clearEntrypoint {
+		log.Info("Clearing the image entrypoint")
+		config.Config.Entrypoint = []string{}
+	}
+
 	// Check for and calculate CPU shares
 	setCpuLimit(config, taskInfo, forceCpuLimit, useCpuShares)
 
@@ -201,15 +438,40 @@ func ConfigForTask(taskInfo *mesos.TaskInfo, forceCpuLimit bool, forceMemoryLimi
 		memoryLimit := int64(memory.Scalar.Value * float64(1024*1024))
 		log.Infof("Memory limit set to %.0fMB [HostConfig.Memory=%d] ", memory.Scalar.Value, memoryLimit)
 		config.HostConfig.Memory = int64(memoryLimit)
+
+		// Without MemorySwap, Docker lets the container use unlimited swap.
+		// MemorySwap is the total of memory plus swap, so a multiplier of 1
+		// disables swap entirely.
+		if memorySwapMultiplier < 1 {
+			log.Warnf("Invalid memory swap multiplier %.2f, disabling swap", memorySwapMultiplier)
+			memorySwapMultiplier = 1
+		}
+		config.HostConfig.MemorySwap = int64(float64(memoryLimit) * memorySwapMultiplier)
+		log.Infof("Memory+swap limit set to %.0fMB [HostConfig.MemorySwap=%d]",
+			memory.Scalar.Value*memorySwapMultiplier, config.HostConfig.MemorySwap)
+	}
+
+	// Check for and set the disk quota. This is only supported by some Docker
+	// storage drivers, so it's opt-in. It wins over a size the task asked for,
+	// since it's what the task was given.
+	disk := getResource("disk", taskInfo)
+	if disk != nil && forceDiskLimit {
+		diskLimit := fmt.Sprintf("%.0fM", disk.Scalar.Value)
+		log.Infof("Disk limit set to %.0fMB [HostConfig.StorageOpt[size]=%s]", disk.Scalar.Value, diskLimit)
+
+		if config.HostConfig.StorageOpt == nil {
+			config.HostConfig.StorageOpt = make(map[string]string)
+		}
+		if size, ok := config.HostConfig.StorageOpt["size"]; ok {
+			log.Warnf("Replacing the task's storage-opt size=%s with the disk limit", size)
+		}
+		config.HostConfig.StorageOpt["size"] = diskLimit
 	}
 
 	// We waste some CPU here when debugging is off...
 	jsonTaskInfo, _ := json.Marshal(*taskInfo)
 	log.Debugf("Mesos TaskInfo: %s", jsonTaskInfo)
 
-	jsonConfig, _ := json.Marshal(config)
-	log.Debugf("Final config: %s", jsonConfig)
-
 	return config
 }
 
@@ -397,6 +659,170 @@ func EnvForTask(taskInfo *mesos.TaskInfo, labels map[string]string,
 	return envVars
 }
 
+// The build and deploy metadata we pass through from the Mesos task labels of
+// the same name, so the app can report what it's running
+var deployMetadataLabels = []string{"DEPLOY_ID", "GIT_SHA", "BUILD_TIME"}
+
+// deployMetadataEnv returns an env var for each of the deployMetadataLabels
+// set on the Mesos task. Those that aren't set are left out, rather than
+// passed empty.
+func deployMetadataEnv(taskInfo *mesos.TaskInfo) []string {
+	if taskInfo.Labels == nil {
+		return nil
+	}
+
+	taskLabels := make(map[string]string, len(taskInfo.Labels.Labels))
+	for _, label := range taskInfo.Labels.Labels {
+		taskLabels[label.Key] = label.GetValue()
+	}
+
+	var envVars []string
+	for _, name := range deployMetadataLabels {
+		if value := taskLabels[name]; value != "" {
+			envVars = append(envVars, name+"="+value)
+		}
+	}
+
+	return envVars
+}
+
+// otelResourceAttributes sets OTEL_RESOURCE_ATTRIBUTES in the env, so that
+// OpenTelemetry SDKs in the container report the service.name and
+// deployment.environment from the ServiceName and Environment labels. Those
+// have already been filled in from the Mesos task labels. Any attributes the
+// task set itself are kept, and win over ours.
+func otelResourceAttributes(envVars []string, labels map[string]string) []string {
+	const prefix = "OTEL_RESOURCE_ATTRIBUTES="
+
+	// The task may have set some attributes already
+	existing := -1
+	taskAttrs := make(map[string]bool)
+	for i, envVar := range envVars {
+		if !strings.HasPrefix(envVar, prefix) {
+			continue
+		}
+
+		existing = i
+		for _, attr := range strings.Split(strings.TrimPrefix(envVar, prefix), ",") {
+			taskAttrs[strings.TrimSpace(strings.SplitN(attr, "=", 2)[0])] = true
+		}
+	}
+
+	var attrs []string
+	for _, mapping := range []struct{ label, attr string }{
+		{"ServiceName", "service.name"},
+		{"Environment", "deployment.environment"},
+	} {
+		value := labels[mapping.label]
+		if value == "" || taskAttrs[mapping.attr] {
+			continue
+		}
+
+		// Values are percent encoded, like W3C baggage
+		value = strings.Replace(url.QueryEscape(value), "+", "%20", -1)
+		attrs = append(attrs, mapping.attr+"="+value)
+	}
+
+	if len(attrs) < 1 {
+		return envVars
+	}
+
+	if existing < 0 {
+		return append(envVars, prefix+strings.Join(attrs, ","))
+	}
+
+	// Don't modify the caller's env
+	merged := make([]string, len(envVars))
+	copy(merged, envVars)
+	if taskValue := strings.TrimPrefix(envVars[existing], prefix); taskValue != "" {
+		attrs = append(attrs, taskValue)
+	}
+	merged[existing] = prefix + strings.Join(attrs, ",")
+
+	return merged
+}
+
+// AgentFacts returns the values about the Mesos agent that we know at launch
+// time and that can be templated into env vars, keyed by placeholder name.
+func AgentFacts(taskInfo *mesos.TaskInfo) map[string]string {
+	facts := make(map[string]string, 3)
+
+	if hostname := getHostname(taskInfo); hostname != "" {
+		facts["AGENT_HOSTNAME"] = hostname
+	}
+
+	if taskInfo.AgentID.Value != "" {
+		facts["AGENT_ID"] = taskInfo.AgentID.Value
+	}
+
+	// Mesos tells the executor how to reach the agent as IP:port
+	if endpoint := os.Getenv("MESOS_AGENT_ENDPOINT"); endpoint != "" {
+		if host, _, err := net.SplitHostPort(endpoint); err == nil {
+			facts["AGENT_IP"] = host
+		}
+	}
+
+	return facts
+}
+
+// TemplateEnv replaces ${AGENT_*} placeholders in env var values with the
+// matching agent facts. Unknown placeholders are left untouched.
+func TemplateEnv(envVars []string, facts map[string]string) []string {
+	templated := make([]string, 0, len(envVars))
+
+	for _, envVar := range envVars {
+		envVar = agentFactExpr.ReplaceAllStringFunc(envVar, func(placeholder string) string {
+			name := placeholder[2 : len(placeholder)-1]
+			if value, ok := facts[name]; ok {
+				return value
+			}
+
+			log.Warnf("Unknown placeholder %s in env var, leaving it alone", placeholder)
+			return placeholder
+		})
+
+		templated = append(templated, envVar)
+	}
+
+	return templated
+}
+
+// EnvFromFiles reads env vars from files on the agent, e.g. secrets put there
+// by another system. Each is requested with an executor.EnvFile.<NAME> label
+// whose value is the file path, optionally followed by ",required". A missing
+// file is skipped unless it was required, in which case we return an error.
+func EnvFromFiles(labels map[string]string) ([]string, error) {
+	const prefix = "executor.EnvFile."
+
+	var names []string
+	for label := range labels {
+		if strings.HasPrefix(label, prefix) && len(label) > len(prefix) {
+			names = append(names, strings.TrimPrefix(label, prefix))
+		}
+	}
+	sort.Strings(names)
+
+	var envVars []string
+	for _, name := range names {
+		path := labels[prefix+name]
+		required := strings.HasSuffix(path, ",required")
+		path = strings.TrimSuffix(path, ",required")
+
+		value, err := ioutil.ReadFile(path)
+		if err != nil {
+			if required {
+				return nil, fmt.Errorf("Unable to read required env var %s from %s: %s", name, path, err)
+			}
+			log.Warnf("Unable to read env var %s from %s, skipping: %s", name, path, err)
+			continue
+		}
+
+		envVars = append(envVars, name+"="+strings.TrimRight(string(value), "\r\n"))
+	}
+
+	return envVars, nil
+}
+
 // LabelsForTask maps Mesos parameter lables to Docker labels
 func LabelsForTask(taskInfo *mesos.TaskInfo) map[string]string {
 	labels := make(map[string]string, len(taskInfo.Container.Docker.Parameters))
@@ -413,6 +839,112 @@ func LabelsForTask(taskInfo *mesos.TaskInfo) map[string]string {
 	return labels
 }
 
+// addSidecarLabels makes sure the container has the ServiceName and
+// Environment labels that Sidecar uses to discover it, so the image doesn't
+// have to be labeled by hand. Labels passed as Docker parameters win. Then we
+// look in the Mesos task labels, and finally fall back to the task name for
+// the ServiceName.
+func addSidecarLabels(labels map[string]string, taskInfo *mesos.TaskInfo) {
+	taskLabels := make(map[string]string)
+	if taskInfo.Labels != nil {
+		for _, label := range taskInfo.Labels.Labels {
+			taskLabels[label.Key] = label.GetValue()
+		}
+	}
+
+	for _, key := range []string{"ServiceName", "Environment"} {
+		if _, ok := labels[key]; ok {
+			continue
+		}
+
+		if value := taskLabels[key]; value != "" {
+			labels[key] = value
+		}
+	}
+
+	if _, ok := labels["ServiceName"]; !ok && taskInfo.GetName() != "" {
+		labels["ServiceName"] = taskInfo.GetName()
+	}
+}
+
+// PlatformForTask returns the os/arch platform the task asked for with the
+// Platform label, defaulting to the platform we are running on.
+func PlatformForTask(labels map[string]string) string {
+	if platform, ok := labels["Platform"]; ok && platform != "" {
+		return platform
+	}
+
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// CheckPlatform makes sure the Docker daemon runs the platform the task asked
+// for with the Platform label. We can't pass the platform to the pull or the
+// create, so Docker always uses its own, and rather than quietly run the
+// wrong one we return ErrPlatformMismatch. Only the OS and architecture are
+// compared, so a variant like the v8 in linux/arm64/v8 is ignored.
+func CheckPlatform(client DockerClient, labels map[string]string) error {
+	requested, ok := labels["Platform"]
+	if !ok || requested == "" {
+		return nil
+	}
+
+	version, err := client.Version()
+	if err != nil {
+		return fmt.Errorf("Unable to get the Docker daemon's platform: %s", err)
+	}
+	daemon := version.Get("Os") + "/" + version.Get("Arch")
+
+	parts := strings.SplitN(requested, "/", 3)
+	if len(parts) < 2 || parts[0]+"/"+parts[1] != daemon {
+		return fmt.Errorf("%w: task wants %s, daemon runs %s", ErrPlatformMismatch, requested, daemon)
+	}
+
+	return nil
+}
+
+// A cgroup path, or a systemd slice name. Each part may be a name Docker or
+// systemd would accept, and the path may be absolute.
+var cgroupParentExpr = regexp.MustCompile(`^/?[A-Za-z0-9_.:@-]+(/[A-Za-z0-9_.:@-]+)*$`)
+
+// CgroupParentForTask returns the cgroup the container should be created
+// under, from the CgroupParent label, falling back to the default we were
+// configured with. Empty means Docker's own default. Unlike most labels, an
+// invalid value is an error: whatever asked for it is expecting to find the
+// container there.
+func CgroupParentForTask(labels map[string]string, defaultParent string) (string, error) {
+	parent := defaultParent
+	if value, ok := labels["CgroupParent"]; ok && value != "" {
+		parent = value
+	}
+
+	if parent == "" {
+		return "", nil
+	}
+
+	err := ValidateCgroupParent(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return parent, nil
+}
+
+// ValidateCgroupParent checks that the value is a plausible cgroup path, like
+// "/mesos/tasks", or a systemd slice, like "mesos.slice".
+func ValidateCgroupParent(parent string) error {
+	if !cgroupParentExpr.MatchString(parent) {
+		return fmt.Errorf("Invalid cgroup parent '%s'", parent)
+	}
+
+	for _, part := range strings.Split(parent, "/") {
+		if part == "." || part == ".." {
+			return fmt.Errorf("Invalid cgroup parent '%s': relative path components aren't allowed", parent)
+		}
+	}
+
+	return nil
+}
+
 // BindsForTask turns Mesos volume information to Docker volume binds at runtime
 // (equivalent to -v)
 func BindsForTask(taskInfo *mesos.TaskInfo) []string {
@@ -453,6 +985,16 @@ func PortBindingsForTask(taskInfo *mesos.TaskInfo) map[docker.Port][]docker.Port
 	return portBinds
 }
 
+// BindPortsToHostIP publishes the ports on a single host IP. Docker publishes
+// on all interfaces when the IP is empty.
+func BindPortsToHostIP(portBinds map[docker.Port][]docker.PortBinding, hostIP string) {
+	for _, binds := range portBinds {
+		for i := range binds {
+			binds[i].HostIP = hostIP
+		}
+	}
+}
+
 // CapAddForTask scans for cap-adds and generate string slice
 func CapAddForTask(taskInfo *mesos.TaskInfo) []string {
 	var params []string
@@ -471,6 +1013,226 @@ func CapDropForTask(taskInfo *mesos.TaskInfo) []string {
 	return params
 }
 
+// SecurityOptForTask scans for security-opts, like AppArmor profiles and
+// SELinux labels. Anything not in key=value form is logged and skipped.
+func SecurityOptForTask(taskInfo *mesos.TaskInfo) []string {
+	var opts []string
+	for _, param := range getParams("security-opt", taskInfo) {
+		// Docker accepts this one on its own
+		if param.Value == "no-new-privileges" {
+			opts = append(opts, param.Value)
+			continue
+		}
+
+		values := strings.SplitN(param.Value, "=", 2)
+		if len(values) < 2 || values[0] == "" || values[1] == "" {
+			log.Warnf("Skipping invalid security-opt '%s', expected key=value", param.Value)
+			continue
+		}
+		opts = append(opts, param.Value)
+	}
+	return opts
+}
+
+// StorageOptForTask scans for storage-opts, like an overlay size, and maps
+// them to the storage options Docker expects. Anything not in key=value form
+// is logged and skipped. Returns nil when there are none.
+func StorageOptForTask(taskInfo *mesos.TaskInfo) map[string]string {
+	var opts map[string]string
+	for _, param := range getParams("storage-opt", taskInfo) {
+		values := strings.SplitN(param.Value, "=", 2)
+		if len(values) < 2 || values[0] == "" || values[1] == "" {
+			log.Warnf("Skipping invalid storage-opt '%s', expected key=value", param.Value)
+			continue
+		}
+
+		if opts == nil {
+			opts = make(map[string]string)
+		}
+		opts[values[0]] = values[1]
+	}
+	return opts
+}
+
+// TmpfsForTask scans for tmpfs mounts, in the same form as `docker run
+// --tmpfs`, e.g. "/tmp" or "/tmp:rw,size=64m,mode=1777". This also works for
+// /dev/shm when the task needs to set more than its size. Mounts that aren't
+// absolute paths, or that have invalid options, are logged and skipped.
+// Returns nil when there are none.
+func TmpfsForTask(taskInfo *mesos.TaskInfo) map[string]string {
+	var mounts map[string]string
+	for _, param := range getParams("tmpfs", taskInfo) {
+		values := strings.SplitN(param.Value, ":", 2)
+		if !path.IsAbs(values[0]) {
+			log.Warnf("Skipping invalid tmpfs '%s', expected an absolute path", param.Value)
+			continue
+		}
+
+		var options string
+		if len(values) > 1 {
+			options = values[1]
+		}
+
+		if err := validateTmpfsOptions(options); err != nil {
+			log.Warnf("Skipping invalid tmpfs '%s': %s", param.Value, err)
+			continue
+		}
+
+		if mounts == nil {
+			mounts = make(map[string]string)
+		}
+		mounts[path.Clean(values[0])] = options
+	}
+	return mounts
+}
+
+// validateTmpfsOptions checks the comma-separated mount options for a tmpfs.
+// We only allow the ones that make sense for tmpfs, so that a typo fails here
+// rather than when Docker mounts it.
+func validateTmpfsOptions(options string) error {
+	if options == "" {
+		return nil
+	}
+
+	for _, option := range strings.Split(options, ",") {
+		values := strings.SplitN(option, "=", 2)
+		key := values[0]
+
+		if len(values) == 1 {
+			switch key {
+			case "rw", "ro", "exec", "noexec", "suid", "nosuid", "dev", "nodev":
+				continue
+			default:
+				return fmt.Errorf("unknown option '%s'", option)
+			}
+		}
+
+		value := values[1]
+		switch key {
+		case "size":
+			size, err := units.RAMInBytes(value)
+			if err != nil || size < 1 {
+				return fmt.Errorf("invalid size '%s'", value)
+			}
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return fmt.Errorf("invalid mode '%s', expected octal permissions", value)
+			}
+		case "uid", "gid", "nr_inodes":
+			if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+				return fmt.Errorf("invalid %s '%s'", key, value)
+			}
+		default:
+			return fmt.Errorf("unknown option '%s'", option)
+		}
+	}
+
+	return nil
+}
+
+// ShmSizeForTask returns the size of /dev/shm in bytes from the ShmSize label,
+// which may use units like "256m" or "1g". Returns 0, the Docker default,
+// when the label is missing or doesn't parse.
+func ShmSizeForTask(labels map[string]string) int64 {
+	value, ok := labels["ShmSize"]
+	if !ok {
+		return 0
+	}
+
+	size, err := units.RAMInBytes(value)
+	if err != nil || size < 0 {
+		log.Warnf("Ignoring invalid ShmSize '%s'", value)
+		return 0
+	}
+
+	return size
+}
+
+// JsonFileLogConfig returns the log config that caps the size of the
+// container's log files, using the json-file driver that we can also read the
+// logs back from. Like Docker, maxFile only applies along with maxSize. With
+// neither set, it returns an empty config and Docker's default driver is used.
+func JsonFileLogConfig(maxSize string, maxFile int) (docker.LogConfig, error) {
+	if maxSize == "" && maxFile == 0 {
+		return docker.LogConfig{}, nil
+	}
+
+	if maxSize == "" {
+		return docker.LogConfig{}, fmt.Errorf("Log max file count %d requires a max size", maxFile)
+	}
+
+	size, err := units.RAMInBytes(maxSize)
+	if err != nil || size < 1 {
+		return docker.LogConfig{}, fmt.Errorf("Invalid log max size '%s'", maxSize)
+	}
+
+	if maxFile < 0 {
+		return docker.LogConfig{}, fmt.Errorf("Invalid log max file count %d", maxFile)
+	}
+
+	logConfig := docker.LogConfig{
+		Type:   "json-file",
+		Config: map[string]string{"max-size": maxSize},
+	}
+
+	if maxFile > 0 {
+		logConfig.Config["max-file"] = strconv.Itoa(maxFile)
+	}
+
+	return logConfig, nil
+}
+
+// PidModeForTask scans for the pid namespace mode, which may be "host" or
+// "container:<id>". Invalid modes are logged and skipped.
+func PidModeForTask(taskInfo *mesos.TaskInfo) string {
+	return namespaceModeForTask("pid", []string{"host"}, true, taskInfo)
+}
+
+// IpcModeForTask scans for the ipc namespace mode, which may be one of the
+// Docker modes or "container:<id>". Invalid modes are logged and skipped.
+func IpcModeForTask(taskInfo *mesos.TaskInfo) string {
+	return namespaceModeForTask("ipc", []string{"none", "private", "shareable", "host"}, true, taskInfo)
+}
+
+// UsernsModeForTask scans for the user namespace mode. When the Docker daemon
+// remaps users into their own namespace, "host" opts the task out of that.
+// The remapping itself is daemon-wide, so that's the only mode Docker allows.
+// Invalid modes are logged and skipped.
+func UsernsModeForTask(taskInfo *mesos.TaskInfo) string {
+	return namespaceModeForTask("userns", []string{"host"}, false, taskInfo)
+}
+
+// namespaceModeForTask finds the last valid setting for the param. Sharing
+// the namespace of another container is allowed when it's shareable.
+func namespaceModeForTask(key string, allowed []string, shareable bool, taskInfo *mesos.TaskInfo) string {
+	var mode string
+
+	for _, param := range getParams(key, taskInfo) {
+		if shareable && strings.HasPrefix(param.Value, "container:") && len(param.Value) > len("container:") {
+			mode = param.Value
+			continue
+		}
+
+		valid := false
+		for _, allowedMode := range allowed {
+			if param.Value == allowedMode {
+				valid = true
+				break
+			}
+		}
+
+		if !valid {
+			log.Warnf("Skipping invalid %s mode '%s'", key, param.Value)
+			continue
+		}
+
+		mode = param.Value
+	}
+
+	return mode
+}
+
 // VolumeDriverForTask scans for volume-driver
 func VolumeDriverForTask(taskInfo *mesos.TaskInfo) string {
 	var volumeDriver string
@@ -484,6 +1246,33 @@ func VolumeDriverForTask(taskInfo *mesos.TaskInfo) string {
 	return volumeDriver
 }
 
+// NetworksForTask scans for additional networks to attach the container to
+func NetworksForTask(taskInfo *mesos.TaskInfo) []string {
+	var networks []string
+	for _, param := range getParams("network", taskInfo) {
+		networks = append(networks, param.Value)
+	}
+	return networks
+}
+
+// parseNetwork splits a network parameter into the network name and any
+// aliases. Docker doesn't allow colons in network names.
+func parseNetwork(value string) (string, []string) {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) < 2 {
+		return value, nil
+	}
+
+	var aliases []string
+	for _, alias := range strings.Split(parts[1], ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliases = append(aliases, alias)
+		}
+	}
+
+	return parts[0], aliases
+}
+
 // NetworkForTask maps Mesos enum to strings for Docker
 func NetworkForTask(taskInfo *mesos.TaskInfo) string {
 	var networkMode string
@@ -513,6 +1302,75 @@ func getResource(name string, taskInfo *mesos.TaskInfo) *mesos.Resource {
 	return nil
 }
 
+// DecodeTaskData takes the raw Data blob from a Mesos TaskInfo and returns the
+// plain payload. Large payloads may be sent by the scheduler gzipped, base64
+// encoded, or both (gzip then base64). We detect each of those and unwrap
+// them. Data that is neither is returned unchanged.
+func DecodeTaskData(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	// Plenty of plain payloads, like short IDs or tokens, also happen to be
+	// valid base64. So we only take the decoded bytes when they're something
+	// a scheduler would have encoded: gzip, or a JSON object or array.
+	trimmed := bytes.TrimSpace(data)
+	decoded := make([]byte, base64.StdEncoding.DecodedLen(len(trimmed)))
+	n, err := base64.StdEncoding.Decode(decoded, trimmed)
+	if err == nil && (isGzipped(decoded[:n]) || isJsonDocument(decoded[:n])) {
+		data = decoded[:n]
+	}
+
+	if !isGzipped(data) {
+		return data, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress task data: %s", err)
+	}
+	defer reader.Close()
+
+	uncompressed, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress task data: %s", err)
+	}
+
+	return uncompressed, nil
+}
+
+// isGzipped checks for the gzip magic number at the start of the data
+func isGzipped(data []byte) bool {
+	return len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// isJsonDocument checks for a valid JSON object or array. Bare values like
+// numbers are left out, because short plain payloads can decode to those.
+func isJsonDocument(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return false
+	}
+
+	return json.Valid(trimmed)
+}
+
+// StorageOptError wraps an error from creating a container with storage
+// options, like a disk quota, to explain what the Docker daemon needs in
+// order to support them.
+func StorageOptError(err error, opts map[string]string) error {
+	var keys []string
+	for key := range opts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return fmt.Errorf(
+		"%s (storage options [%s] require a storage driver supporting them, e.g. 'size' needs overlay2 on xfs with pquota, devicemapper, btrfs, or zfs)",
+		err, strings.Join(keys, ", "),
+	)
+}
+
 // Prefix used to name Docker containers in order to distinguish those
 // created by Mesos from those created manually.
 const DockerNamePrefix = "mesos-"
@@ -534,3 +1392,58 @@ func GetExitCode(client DockerClient, containerId string) (int, error) {
 	}
 	return inspect.State.ExitCode, nil
 }
+
+// WasOOMKilled reports whether the kernel killed the container for running
+// out of memory. Errors inspecting the container are treated as "no".
+func WasOOMKilled(client DockerClient, containerId string) bool {
+	inspect, err := client.InspectContainer(containerId)
+	if err != nil {
+		log.Warnf("Unable to check if container %s was OOM killed: %s", containerId, err)
+		return false
+	}
+	return inspect.State.OOMKilled
+}
+
+// SummarizeChanges describes the changes to a container's filesystem: first
+// how many paths were added, modified, and deleted, then up to max of the
+// paths themselves, in the same form as `docker diff`.
+func SummarizeChanges(changes []docker.Change, max int) []string {
+	var added, modified, deleted int
+	for _, change := range changes {
+		switch change.Kind {
+		case docker.ChangeAdd:
+			added++
+		case docker.ChangeModify:
+			modified++
+		case docker.ChangeDelete:
+			deleted++
+		}
+	}
+
+	summary := []string{
+		fmt.Sprintf("%d added, %d modified, %d deleted", added, modified, deleted),
+	}
+
+	for i, change := range changes {
+		if i >= max {
+			summary = append(summary, fmt.Sprintf("... and %d more", len(changes)-max))
+			break
+		}
+		summary = append(summary, changeKind(change.Kind)+" "+change.Path)
+	}
+
+	return summary
+}
+
+// changeKind returns the letter `docker diff` uses for the kind of change
+func changeKind(kind docker.ChangeType) string {
+	switch kind {
+	case docker.ChangeAdd:
+		return "A"
+	case docker.ChangeModify:
+		return "C"
+	case docker.ChangeDelete:
+		return "D"
+	}
+	return "?"
+}
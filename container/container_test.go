@@ -2,8 +2,12 @@ package container
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
 	"io/ioutil"
 	"log"
+	"os"
 	"runtime"
 	"strings"
 	"testing"
@@ -38,7 +42,7 @@ func Test_PullImage(t *testing.T) {
 		dockerClient := &MockDockerClient{}
 
 		Convey("passes the right params", func() {
-			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{})
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 0)
 
 			So(dockerClient.ValidOptions, ShouldBeTrue)
 			So(err, ShouldBeNil)
@@ -46,7 +50,7 @@ func Test_PullImage(t *testing.T) {
 
 		Convey("bubbles up errors", func() {
 			dockerClient.PullImageShouldError = true
-			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{})
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 0)
 
 			So(err, ShouldNotBeNil)
 			So(err.Error(), ShouldContainSubstring, "Something went wrong")
@@ -54,7 +58,7 @@ func Test_PullImage(t *testing.T) {
 
 		Convey("retries pulling image PullImageNumRetries times", func() {
 			dockerClient.PullImageShouldError = true
-			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{})
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 0)
 
 			So(err, ShouldNotBeNil)
 			So(dockerClient.PullImageRetries, ShouldEqual, PullImageNumRetries)
@@ -63,11 +67,83 @@ func Test_PullImage(t *testing.T) {
 
 		Convey("eventually succeeds pulling image", func() {
 			dockerClient.PullImageSuccessAfterNumRetries = 3
-			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{})
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 0)
 
 			So(err, ShouldBeNil)
 			So(dockerClient.PullImageRetries, ShouldEqual, 3)
 		})
+
+		Convey("aborts a pull that stalls, without retrying", func() {
+			dockerClient.PullImageProgress = []string{`{"status":"Downloading"}`}
+			dockerClient.PullImageStalls = true
+
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 50*time.Millisecond)
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Image pull stalled: no progress for 50ms")
+			So(dockerClient.PullImageRetries, ShouldEqual, 1)
+		})
+
+		Convey("lets a slow pull carry on while it makes progress", func() {
+			// Ten events 10ms apart take longer than the timeout
+			for i := 0; i < 10; i++ {
+				dockerClient.PullImageProgress = append(dockerClient.PullImageProgress,
+					`{"status":"Downloading"}`)
+			}
+
+			err := PullImage(dockerClient, taskInfo, &docker.AuthConfiguration{}, 50*time.Millisecond)
+
+			So(err, ShouldBeNil)
+			So(dockerClient.ValidOptions, ShouldBeTrue)
+		})
+	})
+}
+
+func Test_PlatformForTask(t *testing.T) {
+	Convey("PlatformForTask()", t, func() {
+		Convey("uses the Platform label when set", func() {
+			labels := map[string]string{"Platform": "linux/arm64"}
+			So(PlatformForTask(labels), ShouldEqual, "linux/arm64")
+		})
+
+		Convey("defaults to the host platform", func() {
+			So(PlatformForTask(map[string]string{}), ShouldEqual, runtime.GOOS+"/"+runtime.GOARCH)
+		})
+	})
+}
+
+func Test_CheckPlatform(t *testing.T) {
+	Convey("CheckPlatform()", t, func() {
+		client := &MockDockerClient{DaemonPlatform: "linux/amd64"}
+
+		Convey("accepts tasks that don't ask for a platform", func() {
+			client.VersionShouldError = true
+			So(CheckPlatform(client, map[string]string{}), ShouldBeNil)
+		})
+
+		Convey("accepts the daemon's own platform", func() {
+			So(CheckPlatform(client, map[string]string{"Platform": "linux/amd64"}), ShouldBeNil)
+		})
+
+		Convey("ignores the variant", func() {
+			client.DaemonPlatform = "linux/arm64"
+			So(CheckPlatform(client, map[string]string{"Platform": "linux/arm64/v8"}), ShouldBeNil)
+		})
+
+		Convey("refuses any other platform", func() {
+			err := CheckPlatform(client, map[string]string{"Platform": "linux/arm64"})
+			So(errors.Is(err, ErrPlatformMismatch), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "task wants linux/arm64, daemon runs linux/amd64")
+
+			So(CheckPlatform(client, map[string]string{"Platform": "arm64"}), ShouldNotBeNil)
+		})
+
+		Convey("returns an error when Docker can't tell us", func() {
+			client.VersionShouldError = true
+			err := CheckPlatform(client, map[string]string{"Platform": "linux/amd64"})
+			So(err, ShouldNotBeNil)
+			So(errors.Is(err, ErrPlatformMismatch), ShouldBeFalse)
+		})
 	})
 }
 
@@ -137,6 +213,78 @@ func Test_StopContainer(t *testing.T) {
 	})
 }
 
+func Test_WasHardKilled(t *testing.T) {
+	Convey("WasHardKilled()", t, func() {
+		dockerClient := &MockDockerClient{
+			Container: &docker.Container{
+				State: docker.State{Status: "exited", ExitCode: 137},
+			},
+		}
+
+		Convey("is true when the container exited from a SIGKILL", func() {
+			So(WasHardKilled(dockerClient, "someid"), ShouldBeTrue)
+		})
+
+		Convey("is false when the container stopped on SIGTERM", func() {
+			dockerClient.Container.State.ExitCode = 143
+			So(WasHardKilled(dockerClient, "someid"), ShouldBeFalse)
+		})
+
+		Convey("is false when the container was OOM killed", func() {
+			dockerClient.Container.State.OOMKilled = true
+			So(WasHardKilled(dockerClient, "someid"), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_ConnectNetworks(t *testing.T) {
+	Convey("When connecting to additional networks", t, func() {
+		taskInfo := &mesos.TaskInfo{
+			Container: &mesos.ContainerInfo{
+				Docker: &mesos.ContainerInfo_DockerInfo{
+					Parameters: []mesos.Parameter{
+						{Key: "network", Value: "mesh"},
+						{Key: "label", Value: "ServiceName=beowulf"},
+						{Key: "network", Value: "backend"},
+					},
+				},
+			},
+		}
+
+		dockerClient := &MockDockerClient{}
+
+		Convey("finds all the networks in the task", func() {
+			So(NetworksForTask(taskInfo), ShouldResemble, []string{"mesh", "backend"})
+		})
+
+		Convey("connects the container to each network", func() {
+			err := ConnectNetworks(dockerClient, "someid", NetworksForTask(taskInfo))
+
+			So(err, ShouldBeNil)
+			So(dockerClient.ConnectedNetworks, ShouldResemble, []string{"mesh", "backend"})
+		})
+
+		Convey("passes the aliases for each network", func() {
+			taskInfo.Container.Docker.Parameters[2].Value = "backend:beowulf, geat"
+			err := ConnectNetworks(dockerClient, "someid", NetworksForTask(taskInfo))
+
+			So(err, ShouldBeNil)
+			So(dockerClient.ConnectedNetworks, ShouldResemble, []string{"mesh", "backend"})
+			So(dockerClient.ConnectedAliases, ShouldResemble, map[string][]string{
+				"backend": {"beowulf", "geat"},
+			})
+		})
+
+		Convey("bubbles up errors", func() {
+			dockerClient.ConnectNetworkShouldError = true
+			err := ConnectNetworks(dockerClient, "someid", NetworksForTask(taskInfo))
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Unable to connect to network 'mesh'")
+		})
+	})
+}
+
 func Test_GetLogs(t *testing.T) {
 	Convey("Fetches the logs from a task", t, func() {
 		containerId := "mesos-nginx-2392676-1479746266455-1-dev_singularity_sick_sing-DEFAULT"
@@ -174,6 +322,7 @@ func Test_ConfigGeneration(t *testing.T) {
 
 		cpus := float64(0.5) * float64(runtime.NumCPU())
 		memory := float64(128)
+		disk := float64(1024)
 
 		envValue := "SOMETHING=123=123"
 		labelValue := "ANYTHING=123=123"
@@ -249,6 +398,22 @@ func Test_ConfigGeneration(t *testing.T) {
 							Key:   "volume-driver",
 							Value: volumeDriverValue,
 						},
+						{
+							Key:   "label",
+							Value: "ShmSize=128m",
+						},
+						{
+							Key:   "security-opt",
+							Value: "apparmor=docker-default",
+						},
+						{
+							Key:   "security-opt",
+							Value: "label=level:s0",
+						},
+						{
+							Key:   "security-opt",
+							Value: "bogus",
+						},
 					},
 					PortMappings: []mesos.ContainerInfo_DockerInfo_PortMapping{
 						{
@@ -286,6 +451,10 @@ func Test_ConfigGeneration(t *testing.T) {
 					Name:   "mem",
 					Scalar: &mesos.Value_Scalar{Value: memory},
 				},
+				{
+					Name:   "disk",
+					Scalar: &mesos.Value_Scalar{Value: disk},
+				},
 			},
 			Executor: &mesos.ExecutorInfo{
 				Command: &mesos.CommandInfo{
@@ -304,8 +473,16 @@ func Test_ConfigGeneration(t *testing.T) {
 			},
 		}
 
-		opts := ConfigForTask(taskInfo, false, false, false, []string{})
-		optsForced := ConfigForTask(taskInfo, true, true, false, []string{})
+		opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+		optsForced := ConfigForTask(taskInfo, true, true, 1, true, false, []string{})
+
+		Convey("uses the image's command when the task has none", func() {
+			taskInfo.Command = nil
+			taskInfo.Container.Docker.Parameters = nil
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.Config.Cmd, ShouldBeNil)
+		})
 
 		Convey("gets the name from the task ID", func() {
 			So(opts.Name, ShouldEqual, "mesos-"+uuidTaskID)
@@ -326,6 +503,75 @@ func Test_ConfigGeneration(t *testing.T) {
 			So(opts.HostConfig.Memory, ShouldEqual, float64(0))
 		})
 
+		Convey("disables swap by default when limiting memory", func() {
+			So(optsForced.HostConfig.MemorySwap, ShouldEqual, optsForced.HostConfig.Memory)
+			So(opts.HostConfig.MemorySwap, ShouldEqual, 0)
+		})
+
+		Convey("allows swap as a multiple of the memory limit", func() {
+			optsSwap := ConfigForTask(taskInfo, false, true, 1.5, false, false, []string{})
+			So(optsSwap.HostConfig.Memory, ShouldEqual, 128*1024*1024)
+			So(optsSwap.HostConfig.MemorySwap, ShouldEqual, 192*1024*1024)
+		})
+
+		Convey("never sets swap below the memory limit", func() {
+			optsSwap := ConfigForTask(taskInfo, false, true, 0.5, false, false, []string{})
+			So(optsSwap.HostConfig.MemorySwap, ShouldEqual, optsSwap.HostConfig.Memory)
+		})
+
+		Convey("sets the disk limit as a storage opt", func() {
+			So(optsForced.HostConfig.StorageOpt, ShouldResemble, map[string]string{"size": "1024M"})
+			So(opts.HostConfig.StorageOpt, ShouldBeNil)
+		})
+
+		Convey("maps storage-opt parameters to storage opts", func() {
+			taskInfo.Container.Docker.Parameters = append(taskInfo.Container.Docker.Parameters,
+				mesos.Parameter{Key: "storage-opt", Value: "size=20G"},
+				mesos.Parameter{Key: "storage-opt", Value: "nonsense"},
+			)
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.HostConfig.StorageOpt, ShouldResemble, map[string]string{"size": "20G"})
+
+			optsForced := ConfigForTask(taskInfo, false, false, 1, true, false, []string{})
+			So(optsForced.HostConfig.StorageOpt, ShouldResemble, map[string]string{"size": "1024M"})
+		})
+
+		Convey("maps tmpfs parameters to tmpfs mounts", func() {
+			taskInfo.Container.Docker.Parameters = append(taskInfo.Container.Docker.Parameters,
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:rw,size=64m,mode=1777"},
+				mesos.Parameter{Key: "tmpfs", Value: "/run"},
+			)
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.HostConfig.Tmpfs, ShouldResemble, map[string]string{
+				"/tmp": "rw,size=64m,mode=1777",
+				"/run": "",
+			})
+		})
+
+		Convey("skips invalid tmpfs mounts", func() {
+			taskInfo.Container.Docker.Parameters = append(taskInfo.Container.Docker.Parameters,
+				mesos.Parameter{Key: "tmpfs", Value: "tmp:size=64m"},
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:size=lots"},
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:mode=999"},
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:mode=17777"},
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:uid=geat"},
+				mesos.Parameter{Key: "tmpfs", Value: "/tmp:rw,hoard"},
+			)
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.HostConfig.Tmpfs, ShouldBeNil)
+		})
+
+		Convey("explains which storage opts the daemon may not support", func() {
+			err := StorageOptError(errors.New("--storage-opt is not supported"),
+				map[string]string{"size": "20G", "dm.basesize": "10G"})
+
+			So(err.Error(), ShouldStartWith, "--storage-opt is not supported")
+			So(err.Error(), ShouldContainSubstring, "storage options [dm.basesize, size]")
+		})
+
 		Convey("populates the environment", func() {
 			So(len(opts.Config.Env), ShouldBeGreaterThan, 1)
 			So(opts.Config.Env[0], ShouldEqual, "TASK_HOST=beowulf.example.com")
@@ -349,6 +595,69 @@ func Test_ConfigGeneration(t *testing.T) {
 			So(opts.Config.Env, ShouldContain, "ENVIRONMENT="+envName)
 		})
 
+		Convey("sets the labels Sidecar uses for discovery", func() {
+			So(opts.Config.Labels["ServiceName"], ShouldEqual, svcName)
+			So(opts.Config.Labels["Environment"], ShouldEqual, envName)
+		})
+
+		Convey("fills in the Sidecar labels from the Mesos task", func() {
+			mesosEnv := "prod"
+			taskInfo.Name = "beowulf"
+			taskInfo.Labels = &mesos.Labels{
+				Labels: []mesos.Label{{Key: "Environment", Value: &mesosEnv}},
+			}
+			taskInfo.Container.Docker.Parameters = []mesos.Parameter{
+				{Key: "label", Value: labelValue},
+			}
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.Config.Labels["ServiceName"], ShouldEqual, "beowulf")
+			So(opts.Config.Labels["Environment"], ShouldEqual, "prod")
+			So(opts.Config.Env, ShouldContain, "SERVICE_NAME=beowulf")
+		})
+
+		Convey("applies the task spec from the TaskInfo Data", func() {
+			taskInfo.Data = []byte(`{
+				"Env": {"GRENDEL": "monster"},
+				"Volumes": [{"HostPath": "/mnt/mere", "ContainerPath": "/lair", "Mode": "ro"}]
+			}`)
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.Config.Env, ShouldContain, "GRENDEL=monster")
+			So(opts.HostConfig.Binds, ShouldContain, "/mnt/mere:/lair:ro")
+		})
+
+		Convey("passes the deploy metadata from the Mesos task labels", func() {
+			deployId, gitSha := "deploy-0042", "5189f1c"
+			taskInfo.Labels = &mesos.Labels{
+				Labels: []mesos.Label{
+					{Key: "DEPLOY_ID", Value: &deployId},
+					{Key: "GIT_SHA", Value: &gitSha},
+				},
+			}
+
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+			So(opts.Config.Env, ShouldContain, "DEPLOY_ID=deploy-0042")
+			So(opts.Config.Env, ShouldContain, "GIT_SHA=5189f1c")
+
+			for _, envVar := range opts.Config.Env {
+				So(envVar, ShouldNotStartWith, "BUILD_TIME=")
+			}
+		})
+
+		Convey("passes no deploy metadata when the task has none", func() {
+			for _, envVar := range opts.Config.Env {
+				So(envVar, ShouldNotStartWith, "DEPLOY_ID=")
+				So(envVar, ShouldNotStartWith, "GIT_SHA=")
+				So(envVar, ShouldNotStartWith, "BUILD_TIME=")
+			}
+		})
+
+		Convey("sets the OpenTelemetry resource attributes from the labels", func() {
+			So(opts.Config.Env, ShouldContain,
+				"OTEL_RESOURCE_ATTRIBUTES=service.name=dev-test-app,deployment.environment=dev")
+		})
+
 		Convey("maps the version into the environment", func() {
 			So(opts.Config.Env, ShouldContain, "SERVICE_VERSION=1.0.0")
 		})
@@ -374,6 +683,16 @@ func Test_ConfigGeneration(t *testing.T) {
 			So(opts.HostConfig.CapAdd[0], ShouldEqual, "NET_ADMIN")
 		})
 
+		Convey("gets the shm size", func() {
+			So(opts.HostConfig.ShmSize, ShouldEqual, 128*1024*1024)
+		})
+
+		Convey("gets the valid security-opts", func() {
+			So(opts.HostConfig.SecurityOpt, ShouldResemble,
+				[]string{"apparmor=docker-default", "label=level:s0"},
+			)
+		})
+
 		Convey("gets the cap-drops", func() {
 			So(len(opts.HostConfig.CapDrop), ShouldEqual, 1)
 			So(opts.HostConfig.CapDrop[0], ShouldEqual, "NET_ADMIN")
@@ -394,6 +713,15 @@ func Test_ConfigGeneration(t *testing.T) {
 			So(opts.HostConfig.PortBindings["443/tcp"][0].HostPort, ShouldEqual, "10270")
 			So(opts.HostConfig.PortBindings["9090/tcp"][0].HostPort, ShouldEqual, "10271")
 			So(opts.HostConfig.PortBindings["9090/udp"][0].HostPort, ShouldEqual, "10271")
+			So(opts.HostConfig.PortBindings["443/tcp"][0].HostIP, ShouldBeEmpty)
+		})
+
+		Convey("binds the ports to one host IP when asked", func() {
+			BindPortsToHostIP(opts.HostConfig.PortBindings, "10.3.5.8")
+
+			So(opts.HostConfig.PortBindings["443/tcp"][0].HostIP, ShouldEqual, "10.3.5.8")
+			So(opts.HostConfig.PortBindings["9090/udp"][0].HostIP, ShouldEqual, "10.3.5.8")
+			So(opts.HostConfig.PortBindings["9090/udp"][0].HostPort, ShouldEqual, "10271")
 		})
 
 		Convey("uses the right network mode when it's set", func() {
@@ -403,12 +731,12 @@ func Test_ConfigGeneration(t *testing.T) {
 		Convey("defaults to correct network mode", func() {
 			none := mesos.ContainerInfo_DockerInfo_NONE
 			taskInfo.Container.Docker.Network = &none
-			opts := ConfigForTask(taskInfo, false, false, false, []string{})
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
 			So(opts.HostConfig.NetworkMode, ShouldEqual, "none")
 		})
 
 		Convey("supports CPU Shares when requested", func() {
-			opts := ConfigForTask(taskInfo, true, false, true, []string{})
+			opts := ConfigForTask(taskInfo, true, false, 1, false, true, []string{})
 			So(opts.HostConfig.CPUShares, ShouldEqual, 512)
 		})
 
@@ -417,10 +745,26 @@ func Test_ConfigGeneration(t *testing.T) {
 				Name:   "cpus",
 				Scalar: &mesos.Value_Scalar{Value: 35},
 			}
-			opts := ConfigForTask(taskInfo, true, false, true, []string{})
+			opts := ConfigForTask(taskInfo, true, false, 1, false, true, []string{})
 			So(opts.HostConfig.CPUShares, ShouldEqual, 1024)
 		})
 
+		Convey("inherits the image entrypoint by default", func() {
+			So(opts.Config.Entrypoint, ShouldBeNil)
+		})
+
+		Convey("clears the entrypoint when asked to", func() {
+			taskInfo.Container.Docker.Parameters = append(
+				taskInfo.Container.Docker.Parameters,
+				mesos.Parameter{Key: "label", Value: "executor.ClearEntrypoint=true"},
+			)
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+
+			So(opts.Config.Entrypoint, ShouldNotBeNil)
+			So(opts.Config.Entrypoint, ShouldBeEmpty)
+			So(len(opts.Config.Cmd), ShouldEqual, 3)
+		})
+
 		Convey("uses the command when it's set", func() {
 			cmdParts := strings.Split(shellCommand, " ")
 			So(len(opts.Config.Cmd), ShouldEqual, 3)
@@ -428,5 +772,421 @@ func Test_ConfigGeneration(t *testing.T) {
 				So(opts.Config.Cmd[i], ShouldResemble, part)
 			}
 		})
+
+		Convey("when the task only has Mesos Arguments", func() {
+			// Drop the ShellCommand label, which would take precedence
+			var params []mesos.Parameter
+			for _, param := range taskInfo.Container.Docker.Parameters {
+				if !strings.HasPrefix(param.Value, "executor.ShellCommand=") {
+					params = append(params, param)
+				}
+			}
+			taskInfo.Container.Docker.Parameters = params
+
+			shell := false
+			taskInfo.Command = &mesos.CommandInfo{
+				Shell:     &shell,
+				Arguments: []string{"--name", "hrothgar's hall"},
+			}
+
+			Convey("passes them as the argv when Shell is false", func() {
+				opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+
+				So(opts.Config.Cmd, ShouldResemble, []string{"--name", "hrothgar's hall"})
+				So(opts.Config.Entrypoint, ShouldBeNil)
+			})
+
+			Convey("runs them in a shell when Shell is true", func() {
+				shell = true
+				value := "/bin/greet"
+				taskInfo.Command.Value = &value
+
+				opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+
+				So(opts.Config.Entrypoint, ShouldResemble, []string{"/bin/sh", "-c"})
+				So(opts.Config.Cmd, ShouldResemble, []string{`/bin/greet '--name' 'hrothgar'\''s hall'`})
+			})
+
+			Convey("defaults to running them in a shell", func() {
+				taskInfo.Command.Shell = nil
+
+				opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+
+				So(opts.Config.Entrypoint, ShouldResemble, []string{"/bin/sh", "-c"})
+				So(opts.Config.Cmd, ShouldResemble, []string{`'--name' 'hrothgar'\''s hall'`})
+			})
+		})
+	})
+}
+
+func Test_DecodeTaskData(t *testing.T) {
+	Convey("DecodeTaskData()", t, func() {
+		payload := []byte(`{"ServiceName":"beowulf","Environment":"dev"}`)
+
+		gzipped := func(data []byte) []byte {
+			var buf bytes.Buffer
+			writer := gzip.NewWriter(&buf)
+			writer.Write(data)
+			writer.Close()
+			return buf.Bytes()
+		}
+
+		Convey("passes through plain payloads", func() {
+			decoded, err := DecodeTaskData(payload)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, string(payload))
+		})
+
+		Convey("handles empty payloads", func() {
+			decoded, err := DecodeTaskData(nil)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldBeEmpty)
+		})
+
+		Convey("decodes base64 payloads", func() {
+			encoded := []byte(base64.StdEncoding.EncodeToString(payload))
+
+			decoded, err := DecodeTaskData(encoded)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, string(payload))
+		})
+
+		Convey("passes through plain payloads that look like base64", func() {
+			for _, plain := range []string{"deploy12", "abcd", "MTIz", "c2VjcmV0VG9rZW4x"} {
+				decoded, err := DecodeTaskData([]byte(plain))
+				So(err, ShouldBeNil)
+				So(string(decoded), ShouldEqual, plain)
+			}
+		})
+
+		Convey("decompresses gzip payloads", func() {
+			decoded, err := DecodeTaskData(gzipped(payload))
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, string(payload))
+		})
+
+		Convey("decodes and decompresses gzip+base64 payloads", func() {
+			encoded := []byte(base64.StdEncoding.EncodeToString(gzipped(payload)) + "\n")
+
+			decoded, err := DecodeTaskData(encoded)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, string(payload))
+		})
+
+		Convey("returns an error on corrupt gzip payloads", func() {
+			corrupt := gzipped(payload)[:12]
+
+			_, err := DecodeTaskData(corrupt)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Unable to decompress")
+		})
+	})
+}
+
+func Test_NamespaceModes(t *testing.T) {
+	Convey("PidModeForTask(), IpcModeForTask(), and UsernsModeForTask()", t, func() {
+		taskInfo := &mesos.TaskInfo{
+			Container: &mesos.ContainerInfo{
+				Docker: &mesos.ContainerInfo_DockerInfo{},
+			},
+		}
+
+		withParams := func(params ...mesos.Parameter) *mesos.TaskInfo {
+			taskInfo.Container.Docker.Parameters = params
+			return taskInfo
+		}
+
+		Convey("supports host mode", func() {
+			So(PidModeForTask(withParams(mesos.Parameter{Key: "pid", Value: "host"})), ShouldEqual, "host")
+			So(IpcModeForTask(withParams(mesos.Parameter{Key: "ipc", Value: "host"})), ShouldEqual, "host")
+			So(UsernsModeForTask(withParams(mesos.Parameter{Key: "userns", Value: "host"})), ShouldEqual, "host")
+		})
+
+		Convey("supports sharing with another container", func() {
+			So(PidModeForTask(withParams(mesos.Parameter{Key: "pid", Value: "container:deadbeef0010"})),
+				ShouldEqual, "container:deadbeef0010")
+			So(IpcModeForTask(withParams(mesos.Parameter{Key: "ipc", Value: "container:deadbeef0010"})),
+				ShouldEqual, "container:deadbeef0010")
+		})
+
+		Convey("skips invalid modes", func() {
+			So(PidModeForTask(withParams(mesos.Parameter{Key: "pid", Value: "shareable"})), ShouldEqual, "")
+			So(PidModeForTask(withParams(mesos.Parameter{Key: "pid", Value: "container:"})), ShouldEqual, "")
+			So(IpcModeForTask(withParams(mesos.Parameter{Key: "ipc", Value: "bogus"})), ShouldEqual, "")
+			So(UsernsModeForTask(withParams(mesos.Parameter{Key: "userns", Value: "private"})), ShouldEqual, "")
+			So(UsernsModeForTask(withParams(mesos.Parameter{Key: "userns", Value: "container:deadbeef0010"})),
+				ShouldEqual, "")
+		})
+
+		Convey("defaults to Docker's own mode", func() {
+			So(PidModeForTask(withParams()), ShouldEqual, "")
+			So(IpcModeForTask(withParams()), ShouldEqual, "")
+			So(UsernsModeForTask(withParams()), ShouldEqual, "")
+		})
+
+		Convey("ends up in the container config", func() {
+			bridge := mesos.ContainerInfo_DockerInfo_BRIDGE
+			taskInfo.Container.Docker.Image = "foo/foo:1.0.0"
+			taskInfo.Container.Docker.Network = &bridge
+			withParams(
+				mesos.Parameter{Key: "pid", Value: "host"},
+				mesos.Parameter{Key: "ipc", Value: "container:deadbeef0010"},
+				mesos.Parameter{Key: "userns", Value: "host"},
+			)
+			opts := ConfigForTask(taskInfo, false, false, 1, false, false, []string{})
+
+			So(opts.HostConfig.PidMode, ShouldEqual, "host")
+			So(opts.HostConfig.IpcMode, ShouldEqual, "container:deadbeef0010")
+			So(opts.HostConfig.UsernsMode, ShouldEqual, "host")
+		})
+	})
+}
+
+func Test_ShmSizeForTask(t *testing.T) {
+	Convey("ShmSizeForTask()", t, func() {
+		Convey("parses sizes with units", func() {
+			So(ShmSizeForTask(map[string]string{"ShmSize": "256m"}), ShouldEqual, 256*1024*1024)
+			So(ShmSizeForTask(map[string]string{"ShmSize": "1g"}), ShouldEqual, 1024*1024*1024)
+		})
+
+		Convey("parses plain bytes", func() {
+			So(ShmSizeForTask(map[string]string{"ShmSize": "65536"}), ShouldEqual, 65536)
+		})
+
+		Convey("ignores invalid sizes", func() {
+			So(ShmSizeForTask(map[string]string{"ShmSize": "lots"}), ShouldEqual, 0)
+		})
+
+		Convey("defaults to zero when not set", func() {
+			So(ShmSizeForTask(map[string]string{}), ShouldEqual, 0)
+		})
+	})
+}
+
+func Test_CgroupParentForTask(t *testing.T) {
+	Convey("CgroupParentForTask()", t, func() {
+		Convey("uses the CgroupParent label", func() {
+			parent, err := CgroupParentForTask(map[string]string{"CgroupParent": "/mesos/tasks"}, "/default")
+			So(err, ShouldBeNil)
+			So(parent, ShouldEqual, "/mesos/tasks")
+		})
+
+		Convey("falls back to the default", func() {
+			parent, err := CgroupParentForTask(map[string]string{}, "mesos.slice")
+			So(err, ShouldBeNil)
+			So(parent, ShouldEqual, "mesos.slice")
+
+			parent, err = CgroupParentForTask(map[string]string{}, "")
+			So(err, ShouldBeNil)
+			So(parent, ShouldBeEmpty)
+		})
+
+		Convey("rejects implausible paths", func() {
+			for _, value := range []string{"/", "/mesos/../etc", "mesos//tasks", "/mesos tasks", "/mesos/"} {
+				_, err := CgroupParentForTask(map[string]string{"CgroupParent": value}, "")
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "Invalid cgroup parent")
+			}
+		})
+	})
+}
+
+func Test_otelResourceAttributes(t *testing.T) {
+	Convey("otelResourceAttributes()", t, func() {
+		labels := map[string]string{"ServiceName": "beowulf", "Environment": "geats land"}
+
+		Convey("composes the attributes from the labels", func() {
+			env := otelResourceAttributes([]string{"HERO=beowulf"}, labels)
+			So(env, ShouldResemble, []string{
+				"HERO=beowulf",
+				"OTEL_RESOURCE_ATTRIBUTES=service.name=beowulf,deployment.environment=geats%20land",
+			})
+		})
+
+		Convey("keeps the attributes the task set, which win over ours", func() {
+			original := []string{"OTEL_RESOURCE_ATTRIBUTES=service.name=grendel,team=monsters"}
+			env := otelResourceAttributes(original, labels)
+
+			So(env, ShouldResemble, []string{
+				"OTEL_RESOURCE_ATTRIBUTES=deployment.environment=geats%20land,service.name=grendel,team=monsters",
+			})
+			So(original[0], ShouldEqual, "OTEL_RESOURCE_ATTRIBUTES=service.name=grendel,team=monsters")
+		})
+
+		Convey("leaves the env alone without the labels", func() {
+			env := otelResourceAttributes([]string{"HERO=beowulf"}, map[string]string{})
+			So(env, ShouldResemble, []string{"HERO=beowulf"})
+		})
+	})
+}
+
+func Test_JsonFileLogConfig(t *testing.T) {
+	Convey("JsonFileLogConfig()", t, func() {
+		Convey("sets the log opts", func() {
+			logConfig, err := JsonFileLogConfig("10m", 3)
+			So(err, ShouldBeNil)
+			So(logConfig.Type, ShouldEqual, "json-file")
+			So(logConfig.Config, ShouldResemble, map[string]string{"max-size": "10m", "max-file": "3"})
+		})
+
+		Convey("leaves out the file count when not set", func() {
+			logConfig, err := JsonFileLogConfig("10m", 0)
+			So(err, ShouldBeNil)
+			So(logConfig.Config, ShouldResemble, map[string]string{"max-size": "10m"})
+		})
+
+		Convey("leaves the log config to Docker when not set", func() {
+			logConfig, err := JsonFileLogConfig("", 0)
+			So(err, ShouldBeNil)
+			So(logConfig.Type, ShouldBeEmpty)
+			So(logConfig.Config, ShouldBeNil)
+		})
+
+		Convey("rejects invalid settings", func() {
+			_, err := JsonFileLogConfig("lots", 0)
+			So(err, ShouldNotBeNil)
+
+			_, err = JsonFileLogConfig("", 3)
+			So(err, ShouldNotBeNil)
+
+			_, err = JsonFileLogConfig("10m", -1)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func Test_EnvFromFiles(t *testing.T) {
+	Convey("EnvFromFiles()", t, func() {
+		file, err := ioutil.TempFile("", "env-file")
+		So(err, ShouldBeNil)
+		defer os.Remove(file.Name())
+
+		file.WriteString("hrothgar\n")
+		file.Close()
+
+		Convey("reads the env var from the file", func() {
+			envVars, err := EnvFromFiles(map[string]string{
+				"executor.EnvFile.KING": file.Name(),
+				"ServiceName":           "beowulf",
+			})
+
+			So(err, ShouldBeNil)
+			So(envVars, ShouldResemble, []string{"KING=hrothgar"})
+		})
+
+		Convey("reads required env vars that are present", func() {
+			envVars, err := EnvFromFiles(map[string]string{
+				"executor.EnvFile.KING": file.Name() + ",required",
+			})
+
+			So(err, ShouldBeNil)
+			So(envVars, ShouldResemble, []string{"KING=hrothgar"})
+		})
+
+		Convey("skips optional files that are missing", func() {
+			envVars, err := EnvFromFiles(map[string]string{
+				"executor.EnvFile.KING":    file.Name(),
+				"executor.EnvFile.GRENDEL": "/nonexistent/grendel",
+			})
+
+			So(err, ShouldBeNil)
+			So(envVars, ShouldResemble, []string{"KING=hrothgar"})
+		})
+
+		Convey("returns an error when a required file is missing", func() {
+			_, err := EnvFromFiles(map[string]string{
+				"executor.EnvFile.GRENDEL": "/nonexistent/grendel,required",
+			})
+
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "required env var GRENDEL from /nonexistent/grendel")
+		})
+	})
+}
+
+func Test_TemplateEnv(t *testing.T) {
+	Convey("When templating agent facts into the env", t, func() {
+		facts := map[string]string{
+			"AGENT_HOSTNAME": "beowulf.example.com",
+			"AGENT_IP":       "10.0.0.1",
+		}
+
+		Convey("substitutes known placeholders", func() {
+			env := TemplateEnv([]string{
+				"PUBLIC_URL=http://${AGENT_HOSTNAME}:8080",
+				"BIND=${AGENT_IP}",
+				"PLAIN=value",
+			}, facts)
+
+			So(env, ShouldResemble, []string{
+				"PUBLIC_URL=http://beowulf.example.com:8080",
+				"BIND=10.0.0.1",
+				"PLAIN=value",
+			})
+		})
+
+		Convey("leaves unknown placeholders untouched", func() {
+			env := TemplateEnv([]string{"RACK=${AGENT_RACK}", "OTHER=${HOME}"}, facts)
+
+			So(env, ShouldResemble, []string{"RACK=${AGENT_RACK}", "OTHER=${HOME}"})
+		})
+
+		Convey("gathers the agent facts from the task", func() {
+			os.Setenv("MESOS_AGENT_ENDPOINT", "10.0.0.1:5051")
+			defer os.Unsetenv("MESOS_AGENT_ENDPOINT")
+
+			hostname := "beowulf.example.com"
+			taskInfo := &mesos.TaskInfo{
+				AgentID: mesos.AgentID{Value: "agent-1234"},
+				Executor: &mesos.ExecutorInfo{
+					Command: &mesos.CommandInfo{
+						Environment: &mesos.Environment{
+							Variables: []mesos.Environment_Variable{
+								{Name: "TASK_HOST", Value: &hostname},
+							},
+						},
+					},
+				},
+			}
+
+			So(AgentFacts(taskInfo), ShouldResemble, map[string]string{
+				"AGENT_HOSTNAME": "beowulf.example.com",
+				"AGENT_ID":       "agent-1234",
+				"AGENT_IP":       "10.0.0.1",
+			})
+		})
+	})
+}
+
+func Test_SummarizeChanges(t *testing.T) {
+	Convey("SummarizeChanges()", t, func() {
+		changes := []docker.Change{
+			{Path: "/tmp", Kind: docker.ChangeModify},
+			{Path: "/tmp/core.1234", Kind: docker.ChangeAdd},
+			{Path: "/etc/hosts.bak", Kind: docker.ChangeDelete},
+		}
+
+		Convey("counts each kind of change and lists the paths", func() {
+			So(SummarizeChanges(changes, 10), ShouldResemble, []string{
+				"1 added, 1 modified, 1 deleted",
+				"C /tmp",
+				"A /tmp/core.1234",
+				"D /etc/hosts.bak",
+			})
+		})
+
+		Convey("truncates the list of paths", func() {
+			So(SummarizeChanges(changes, 1), ShouldResemble, []string{
+				"1 added, 1 modified, 1 deleted",
+				"C /tmp",
+				"... and 2 more",
+			})
+		})
+
+		Convey("handles a container that changed nothing", func() {
+			So(SummarizeChanges(nil, 10), ShouldResemble, []string{
+				"0 added, 0 modified, 0 deleted",
+			})
+		})
 	})
 }
@@ -3,6 +3,9 @@ package container
 import (
 	"errors"
 	"fmt"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -12,11 +15,14 @@ type MockDockerClient struct {
 	PullImageShouldError            bool // Set either this or PullImageSuccessAfterNumRetries
 	PullImageSuccessAfterNumRetries int  // but not both
 	PullImageRetries                int
+	PullImageProgress               []string // Progress events written during the pull
+	PullImageStalls                 bool     // Makes no progress until the pull is cancelled
 	Images                          []docker.APIImages
 	ListImagesShouldError           bool
 	StopContainerShouldError        bool
 	stopContainerFails              int
 	StopContainerMaxFails           int
+	StopContainerCalls              int
 	InspectContainerShouldError     bool
 	logOpts                         *docker.LogsOptions
 	Container                       *docker.Container
@@ -24,12 +30,76 @@ type MockDockerClient struct {
 	LogErrorString                  string
 	ListContainersShouldError       bool
 	ListContainersContainers        []docker.APIContainers
+	ListContainersDelay             time.Duration
+	ListContainersFailures          int // Fail this many times before succeeding
+	ListContainersCalls             int
 	ContainerStarted                bool
+	ConnectNetworkShouldError       bool
+	ConnectedNetworks               []string
+	ConnectedAliases                map[string][]string
+	ContainerRemoved                bool
+	RemoveContainerCalls            int
+	CreateContainerFailures         int // Fail this many times before succeeding
+	CreateContainerCalls            int
+	StatsSample                     *docker.Stats
+	StatsShouldError                bool
+	StatsDelay                      time.Duration
+	WaitContainerShouldError        bool
+	WaitContainerExitCode           int
+	PauseContainerShouldError       bool
+	ContainerPaused                 bool
+	Changes                         []docker.Change
+	ContainerChangesShouldError     bool
+	LogsFailures                    int // Fail this many times before succeeding
+	LogsCalls                       int
+	HealthStatuses                  []string // Reported in turn by InspectContainer(), the last one sticks
+	DaemonPlatform                  string   // os/arch reported by Version(), defaults to our own
+	VersionShouldError              bool
+}
+
+func (m *MockDockerClient) WaitContainer(id string) (int, error) {
+	if m.WaitContainerShouldError {
+		return 0, errors.New("Something went wrong! [WaitContainer()]")
+	}
+	return m.WaitContainerExitCode, nil
+}
+
+func (m *MockDockerClient) ConnectNetwork(id string, opts docker.NetworkConnectionOptions) error {
+	if m.ConnectNetworkShouldError {
+		return errors.New("Something went wrong! [ConnectNetwork()]")
+	}
+
+	m.ConnectedNetworks = append(m.ConnectedNetworks, id)
+	if opts.EndpointConfig != nil {
+		if m.ConnectedAliases == nil {
+			m.ConnectedAliases = make(map[string][]string)
+		}
+		m.ConnectedAliases[id] = opts.EndpointConfig.Aliases
+	}
+	return nil
+}
+
+func (m *MockDockerClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	m.ContainerRemoved = true
+	m.RemoveContainerCalls += 1
+	return nil
 }
 
 func (m *MockDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
 	m.PullImageRetries = m.PullImageRetries + 1
 
+	for _, event := range m.PullImageProgress {
+		time.Sleep(10 * time.Millisecond)
+		if opts.OutputStream != nil {
+			fmt.Fprintln(opts.OutputStream, event)
+		}
+	}
+
+	if m.PullImageStalls {
+		<-opts.Context.Done()
+		return opts.Context.Err()
+	}
+
 	if m.PullImageShouldError {
 		return errors.New("Something went wrong! [PullImage()]")
 	}
@@ -54,6 +124,8 @@ func (m *MockDockerClient) ListImages(opts docker.ListImagesOptions) ([]docker.A
 }
 
 func (m *MockDockerClient) StopContainer(id string, timeout uint) error {
+	m.StopContainerCalls += 1
+
 	if m.StopContainerShouldError {
 		m.stopContainerFails += 1
 
@@ -64,35 +136,94 @@ func (m *MockDockerClient) StopContainer(id string, timeout uint) error {
 	return nil
 }
 
+func (m *MockDockerClient) ContainerChanges(id string) ([]docker.Change, error) {
+	if m.ContainerChangesShouldError {
+		return nil, errors.New("Something went wrong! [ContainerChanges()]")
+	}
+	return m.Changes, nil
+}
+
+func (m *MockDockerClient) PauseContainer(id string) error {
+	if m.PauseContainerShouldError {
+		return errors.New("Something went wrong! [PauseContainer()]")
+	}
+	m.ContainerPaused = true
+	return nil
+}
+
+func (m *MockDockerClient) Version() (*docker.Env, error) {
+	if m.VersionShouldError {
+		return nil, errors.New("Something went wrong! [Version()]")
+	}
+
+	platform := m.DaemonPlatform
+	if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	parts := strings.SplitN(platform, "/", 2)
+
+	return &docker.Env{"Os=" + parts[0], "Arch=" + parts[1]}, nil
+}
+
+func (m *MockDockerClient) UnpauseContainer(id string) error {
+	m.ContainerPaused = false
+	return nil
+}
+
 func (m *MockDockerClient) InspectContainer(id string) (*docker.Container, error) {
 	if m.InspectContainerShouldError {
 		return nil, errors.New("Something went wrong! [InspectContainer()]")
 	}
 
 	if m.Container != nil {
+		if len(m.HealthStatuses) > 0 {
+			m.Container.State.Health.Status = m.HealthStatuses[0]
+		}
+		if len(m.HealthStatuses) > 1 {
+			m.HealthStatuses = m.HealthStatuses[1:]
+		}
 		return m.Container, nil
 	}
 
 	return nil, errors.New("Forgot to set the mock container! [InspectContainer()]")
 }
 
+// LastLogsOptions returns the options from the most recent call to Logs()
+func (m *MockDockerClient) LastLogsOptions() *docker.LogsOptions {
+	return m.logOpts
+}
+
 func (m *MockDockerClient) Logs(opts docker.LogsOptions) error {
 	m.logOpts = &opts
 
-	_, err := opts.OutputStream.Write([]byte(m.LogOutputString))
-	if err != nil {
-		return err
+	m.LogsCalls += 1
+	if m.LogsCalls <= m.LogsFailures {
+		return errors.New("Something went wrong! [Logs()]")
 	}
 
-	_, err = opts.ErrorStream.Write([]byte(m.LogErrorString))
-	if err != nil {
-		return err
+	if opts.Stdout {
+		_, err := opts.OutputStream.Write([]byte(m.LogOutputString))
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Stderr {
+		_, err := opts.ErrorStream.Write([]byte(m.LogErrorString))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
 func (m *MockDockerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	m.CreateContainerCalls += 1
+	if m.CreateContainerCalls <= m.CreateContainerFailures {
+		return nil, errors.New("Something went wrong! [CreateContainer()]")
+	}
+
 	return &docker.Container{ID: opts.Name}, nil
 }
 
@@ -101,8 +232,27 @@ func (m *MockDockerClient) StartContainer(id string, hostConfig *docker.HostConf
 	return nil
 }
 
+func (m *MockDockerClient) Stats(opts docker.StatsOptions) error {
+	defer close(opts.Stats)
+
+	time.Sleep(m.StatsDelay) // Simulate a slow daemon
+
+	if m.StatsShouldError {
+		return errors.New("Something went wrong! [Stats()]")
+	}
+
+	if m.StatsSample != nil {
+		opts.Stats <- m.StatsSample
+	}
+
+	return nil
+}
+
 func (m *MockDockerClient) ListContainers(opts docker.ListContainersOptions) ([]docker.APIContainers, error) {
-	if m.ListContainersShouldError {
+	time.Sleep(m.ListContainersDelay) // Simulate a slow daemon
+
+	m.ListContainersCalls += 1
+	if m.ListContainersShouldError || m.ListContainersCalls <= m.ListContainersFailures {
 		return nil, errors.New("Something went wrong! [ListContainers()]")
 	}
 
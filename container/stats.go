@@ -0,0 +1,73 @@
+package container
+
+import (
+	"fmt"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// ContainerStats is a single sample of a container's resource usage
+type ContainerStats struct {
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+}
+
+// SampleStats asks Docker for one stats sample for the container. A slow
+// daemon shouldn't hang the caller, so we give up after the timeout.
+func SampleStats(client DockerClient, containerId string, timeout time.Duration) (*ContainerStats, error) {
+	statsChan := make(chan *docker.Stats, 1)
+	errChan := make(chan error, 1)
+	done := make(chan bool)
+	defer close(done)
+
+	go func() {
+		// Stats closes statsChan when it returns
+		errChan <- client.Stats(docker.StatsOptions{
+			ID:      containerId,
+			Stats:   statsChan,
+			Stream:  false,
+			Done:    done,
+			Timeout: timeout,
+		})
+	}()
+
+	select {
+	case stats, ok := <-statsChan:
+		if !ok || stats == nil {
+			err := <-errChan
+			if err == nil {
+				err = fmt.Errorf("No stats returned")
+			}
+			return nil, fmt.Errorf("Unable to get stats for %s: %s", containerId, err)
+		}
+		return statsFromDocker(stats), nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Timed out getting stats for %s after %s", containerId, timeout)
+	}
+}
+
+// statsFromDocker works out the CPU percentage the same way as `docker stats`,
+// from the difference between this sample and the previous one, which Docker
+// includes in a one-shot sample.
+func statsFromDocker(stats *docker.Stats) *ContainerStats {
+	var cpuPercent float64
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
+	numCPUs := len(stats.CPUStats.CPUUsage.PercpuUsage)
+	if numCPUs == 0 {
+		numCPUs = 1
+	}
+
+	if cpuDelta > 0 && systemDelta > 0 {
+		cpuPercent = cpuDelta / systemDelta * float64(numCPUs) * 100
+	}
+
+	return &ContainerStats{
+		CPUPercent:  cpuPercent,
+		MemoryUsage: stats.MemoryStats.Usage,
+		MemoryLimit: stats.MemoryStats.Limit,
+	}
+}
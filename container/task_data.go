@@ -0,0 +1,123 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+)
+
+// Env var names we'll accept in a task spec
+var envNameExpr = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// TaskData is the task spec a scheduler may send as JSON in the TaskInfo Data
+// field. Its Env is added to the container's environment, and its Volumes are
+// bind mounted. We validate it up front so that a malformed spec fails the
+// task with a clear message, instead of a confusing error later on.
+type TaskData struct {
+	Env     map[string]string `json:"Env"`
+	Volumes []TaskVolume      `json:"Volumes"`
+}
+
+// TaskVolume is a bind mount requested in the task spec
+type TaskVolume struct {
+	HostPath      string `json:"HostPath"`
+	ContainerPath string `json:"ContainerPath"`
+	Mode          string `json:"Mode"` // "ro" or "rw", defaults to "rw"
+}
+
+// ParseTaskData parses and validates the decoded TaskInfo Data. Payloads that
+// aren't JSON objects aren't task specs, and are ignored, in which case we
+// return nil. Unknown fields are allowed, since schedulers may send other
+// data along with the spec.
+func ParseTaskData(data []byte) (*TaskData, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, nil
+	}
+
+	var taskData TaskData
+	err := json.Unmarshal(trimmed, &taskData)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid task data: %s", err)
+	}
+
+	err = taskData.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid task data: %s", err)
+	}
+
+	return &taskData, nil
+}
+
+// Validate checks the required fields and allowed values in the spec
+func (d *TaskData) Validate() error {
+	for name := range d.Env {
+		if !envNameExpr.MatchString(name) {
+			return fmt.Errorf("Env: '%s' is not a valid variable name", name)
+		}
+	}
+
+	for i, volume := range d.Volumes {
+		if volume.HostPath == "" {
+			return fmt.Errorf("Volumes[%d]: HostPath is required", i)
+		}
+
+		if !path.IsAbs(volume.HostPath) {
+			return fmt.Errorf("Volumes[%d]: HostPath '%s' must be absolute", i, volume.HostPath)
+		}
+
+		if volume.ContainerPath == "" {
+			return fmt.Errorf("Volumes[%d]: ContainerPath is required", i)
+		}
+
+		if !path.IsAbs(volume.ContainerPath) {
+			return fmt.Errorf("Volumes[%d]: ContainerPath '%s' must be absolute", i, volume.ContainerPath)
+		}
+
+		switch volume.Mode {
+		case "", "ro", "rw":
+		default:
+			return fmt.Errorf("Volumes[%d]: Mode must be one of 'ro' or 'rw', not '%s'", i, volume.Mode)
+		}
+	}
+
+	return nil
+}
+
+// EnvVars returns the Env from the spec as NAME=value pairs, sorted by name.
+// A nil spec has none.
+func (d *TaskData) EnvVars() []string {
+	if d == nil {
+		return nil
+	}
+
+	envVars := make([]string, 0, len(d.Env))
+	for name, value := range d.Env {
+		envVars = append(envVars, name+"="+value)
+	}
+	sort.Strings(envVars)
+
+	return envVars
+}
+
+// Binds returns the Volumes from the spec as Docker bind mounts. A nil spec
+// has none.
+func (d *TaskData) Binds() []string {
+	if d == nil {
+		return nil
+	}
+
+	var binds []string
+	for _, volume := range d.Volumes {
+		bind := volume.HostPath + ":" + volume.ContainerPath
+		if volume.Mode != "" {
+			bind += ":" + volume.Mode
+		}
+		binds = append(binds, bind)
+	}
+
+	return binds
+}
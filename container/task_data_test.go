@@ -0,0 +1,75 @@
+package container
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_ParseTaskData(t *testing.T) {
+	Convey("ParseTaskData()", t, func() {
+		Convey("parses a valid spec", func() {
+			taskData, err := ParseTaskData([]byte(`{
+				"Env": {"BEOWULF": "hero"},
+				"Volumes": [
+					{"HostPath": "/mnt/mead-hall", "ContainerPath": "/data", "Mode": "ro"}
+				]
+			}`))
+
+			So(err, ShouldBeNil)
+			So(taskData.Env["BEOWULF"], ShouldEqual, "hero")
+			So(len(taskData.Volumes), ShouldEqual, 1)
+			So(taskData.Volumes[0].Mode, ShouldEqual, "ro")
+		})
+
+		Convey("turns the spec into env vars and binds", func() {
+			taskData, err := ParseTaskData([]byte(`{
+				"Env": {"WIGLAF": "loyal", "BEOWULF": "hero"},
+				"Volumes": [
+					{"HostPath": "/mnt/mead-hall", "ContainerPath": "/data", "Mode": "ro"},
+					{"HostPath": "/mnt/hoard", "ContainerPath": "/gold"}
+				]
+			}`))
+
+			So(err, ShouldBeNil)
+			So(taskData.EnvVars(), ShouldResemble, []string{"BEOWULF=hero", "WIGLAF=loyal"})
+			So(taskData.Binds(), ShouldResemble, []string{"/mnt/mead-hall:/data:ro", "/mnt/hoard:/gold"})
+		})
+
+		Convey("has no env vars or binds without a spec", func() {
+			var taskData *TaskData
+			So(taskData.EnvVars(), ShouldBeEmpty)
+			So(taskData.Binds(), ShouldBeEmpty)
+		})
+
+		Convey("ignores payloads that aren't a spec", func() {
+			taskData, err := ParseTaskData([]byte("some opaque scheduler data"))
+			So(err, ShouldBeNil)
+			So(taskData, ShouldBeNil)
+
+			taskData, err = ParseTaskData(nil)
+			So(err, ShouldBeNil)
+			So(taskData, ShouldBeNil)
+		})
+
+		Convey("rejects invalid payloads", func() {
+			invalid := map[string]string{
+				`{"Volumes": [{"HostPath": "/mnt"`:                                        "unexpected end of JSON",
+				`{"Volumes": {"HostPath": "/mnt"}}`:                                       "cannot unmarshal object",
+				`{"Env": {"NOT-VALID": "1"}}`:                                             "'NOT-VALID' is not a valid variable name",
+				`{"Volumes": [{"ContainerPath": "/data"}]}`:                               "Volumes[0]: HostPath is required",
+				`{"Volumes": [{"HostPath": "/mnt"}]}`:                                     "Volumes[0]: ContainerPath is required",
+				`{"Volumes": [{"HostPath": "mnt", "ContainerPath": "/data"}]}`:            "HostPath 'mnt' must be absolute",
+				`{"Volumes": [{"HostPath": "/mnt", "ContainerPath": "data"}]}`:            "ContainerPath 'data' must be absolute",
+				`{"Volumes": [{"HostPath": "/mnt", "ContainerPath": "/d", "Mode": "x"}]}`: "Mode must be one of 'ro' or 'rw', not 'x'",
+			}
+
+			for payload, message := range invalid {
+				_, err := ParseTaskData([]byte(payload))
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldStartWith, "Invalid task data: ")
+				So(err.Error(), ShouldContainSubstring, message)
+			}
+		})
+	})
+}
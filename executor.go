@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
-	"net/http"
+	"io"
+	"math/rand"
+	"net"
 	"os"
+	"path"
 	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -15,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/Nitro/sidecar-executor/container"
+	"github.com/Nitro/sidecar-executor/loghooks"
 	"github.com/Nitro/sidecar-executor/vault"
 	"github.com/Nitro/sidecar/service"
 	docker "github.com/fsouza/go-dockerclient"
@@ -26,6 +32,89 @@ import (
 
 const (
 	StillRunning = -1
+
+	// While Sidecar is unreachable, only log about it every this many checks
+	SidecarDownLogEvery = 10
+
+	// How long we'll wait for WaitContainer() to give us an exit code once
+	// an auto-removed container has gone away
+	ExitCodeWaitTime = 5 * time.Second
+
+	// How many changed paths we list when logging a failed container's
+	// filesystem changes
+	MaxFsChanges = 50
+)
+
+// exitResult is what we got from waiting on a container to exit
+type exitResult struct {
+	code int
+	err  error
+}
+
+var (
+	// errNotReady is passed to the watchLooper when the container never
+	// passed its readiness check.
+	errNotReady = errors.New("Container never became ready")
+
+	// errDeadlineExceeded is passed to the watchLooper when the task ran
+	// for longer than its max runtime.
+	errDeadlineExceeded = errors.New("deadline exceeded")
+
+	// errNotDiscovered is returned from the health check when Sidecar never
+	// found the service within the discovery timeout.
+	errNotDiscovered = errors.New("Service was never discovered by Sidecar")
+
+	// errPanicked is returned from the health check when it recovered from
+	// a panic, e.g. in the Docker client.
+	errPanicked = errors.New("Executor panicked while watching the task")
+
+	// errDockerDaemon is returned from the health check when Docker itself
+	// failed, rather than telling us the container is gone.
+	errDockerDaemon = errors.New("Docker daemon error")
+
+	// errUnhealthy and errTombstone are returned from the health check when
+	// Sidecar has reported the service as failed too many times.
+	errUnhealthy = errors.New("Unhealthy container")
+	errTombstone = errors.New("Tombstoned container")
+)
+
+// unhealthyError is returned when Sidecar reported the service as failed too
+// many times. It carries the status Sidecar gave, so that the message we send
+// to Mesos can name it. It matches errUnhealthy, and errTombstone as well when
+// the service was tombstoned.
+type unhealthyError struct {
+	containerId string
+	status      int
+}
+
+func (e *unhealthyError) Error() string {
+	return fmt.Sprintf("%s: %s failing task! Sidecar status: %s",
+		errUnhealthy, e.containerId, strings.ToUpper(service.StatusString(e.status)))
+}
+
+func (e *unhealthyError) Is(target error) bool {
+	return target == errUnhealthy || (target == errTombstone && e.status == service.TOMBSTONE)
+}
+
+// EndReason categorizes why a task ended. It's included in the final status
+// message, and in the task summary, where it can be counted.
+type EndReason string
+
+const (
+	ReasonNone             EndReason = ""
+	ReasonLaunchFailed     EndReason = "launch-failed"
+	ReasonInvalidConfig    EndReason = "invalid-config"
+	ReasonNotReady         EndReason = "not-ready"
+	ReasonUnhealthy        EndReason = "unhealthy"
+	ReasonTombstone        EndReason = "tombstone"
+	ReasonDiscoveryTimeout EndReason = "discovery-timeout"
+	ReasonDeadline         EndReason = "deadline"
+	ReasonDraining         EndReason = "draining"
+	ReasonDrainingTimeout  EndReason = "draining-timeout"
+	ReasonKilled           EndReason = "killed"
+	ReasonOOM              EndReason = "oom"
+	ReasonCrash            EndReason = "crash"
+	ReasonPanic            EndReason = "panic"
 )
 
 // ExecDriver narrowly scopes the interface we expect from a driver. It is
@@ -41,21 +130,80 @@ type ExecDriver interface {
 // the application lifecycle, interacting with Sidecar, launching and killing
 // tasks, etc. It is driven from the ExecutorDriver.
 type sidecarExecutor struct {
-	client          container.DockerClient
-	fetcher         SidecarFetcher
-	watchLooper     director.Looper
-	watcherWg       sync.WaitGroup
-	logsQuitChan    chan struct{}
-	dockerAuth      *docker.AuthConfiguration
-	failCount       int
-	vault           vault.Vault
-	config          Config
-	statusSleepTime time.Duration
+	client           container.DockerClient
+	fetcher          SidecarFetcher
+	watchLooper      director.Looper
+	watcherWg        sync.WaitGroup
+	cancelTask       context.CancelFunc
+	dockerAuth       *docker.AuthConfiguration
+	failCount        int
+	successCount     int
+	sidecarDownCount int
+	dockerErrorCount int
+	vault            vault.Vault
+	config           Config
+	statusSleepTime  time.Duration
 	// Populated during LaunchTask
 	containerConfig *docker.CreateContainerOptions
 	containerID     string
 	driver          ExecDriver
 	awsCredsLease   *vault.VaultAWSCredsLease
+	deadlineTimer   *time.Timer
+	startedAt       time.Time
+	// The last status we saw for our service in Sidecar, and the last state
+	// we fetched it from
+	lastSidecarStatus string
+	sidecarState      sidecarStateCache
+	// What the /health endpoint reports, kept apart for its goroutine
+	health healthState
+	// Only used when Docker auto-removes the container
+	exitChan chan exitResult
+	// When we started health checking, and whether Sidecar has found us
+	checksStartedAt time.Time
+	discovered      bool
+	// The first time Sidecar reported the service as healthy. healthyChan
+	// is closed at the same time, for anyone waiting on it.
+	healthyAt   time.Time
+	healthyChan chan struct{}
+	// Set when the container ignored SIGTERM and had to be killed, or
+	// wouldn't stop at all and had to be force removed
+	hardKilled   bool
+	forceRemoved bool
+	// Whether we already used our one in-place restart
+	restarted bool
+	// Set while we hold an unhealthy container paused for debugging
+	paused bool
+	// Set once we start draining. The drain runs in its own goroutine, so
+	// it's only touched while holding drainLock.
+	draining  bool
+	drainLock sync.Mutex
+	// Set when Mesos asked us to kill the task
+	killRequested bool
+	// Set when we took over a container that was already running
+	attached bool
+	// Set when we were attached to a container to debug it, rather than
+	// given a task. We only watch it, and never stop, restart, or pause it.
+	observeOnly bool
+	// How the container exited, once it has
+	exitCode int
+	// Set once we've seen the container exit, or stopped it ourselves. Only
+	// then is there anything for the post-stop hook to clean up after.
+	containerExited bool
+	// The Mesos task labels, which we may relay with the logs
+	taskLabels map[string]string
+	// Critical tasks aren't assumed healthy when Sidecar can't tell us
+	critical bool
+	// The container named by the executor.SidecarContainer label, whose
+	// service we check in Sidecar instead of our own, and its ID once found
+	checkContainer   string
+	checkContainerID string
+	// Checks service health. When nil, we use Sidecar's HTTP API.
+	sidecar SidecarClient
+	// Where RelayLogsStdout sends container logs, shared by both streams
+	relayStdout     io.Writer
+	relayStdoutLock sync.Mutex
+	// Log lines read but not yet shipped, when RelayMaxInFlight is set
+	relayInFlight int64
 }
 
 // newSidecarExecutor returns a properly configured sidecarExecutor.
@@ -68,11 +216,13 @@ func newSidecarExecutor(client container.DockerClient, auth *docker.AuthConfigur
 
 	return &sidecarExecutor{
 		client:          client,
-		fetcher:         &http.Client{Timeout: config.HttpTimeout},
+		fetcher:         newHttpClient(config),
 		dockerAuth:      auth,
 		vault:           vault.NewDefaultVault(&vaultConfig),
 		config:          config,
 		statusSleepTime: DefaultStatusSleepTime,
+		relayStdout:     os.Stdout,
+		healthyChan:     make(chan struct{}),
 	}
 }
 
@@ -85,34 +235,122 @@ func (exec *sidecarExecutor) logTaskEnv(taskInfo *mesos.TaskInfo, labels map[str
 
 	log.Infof("Docker Environment --------------------")
 	for _, setting := range env {
-		log.Infof(" * %s", redactSetting(setting))
+		log.Infof(" * %s", redactSetting(setting, exec.config.RedactEnvPatterns))
 	}
 	log.Infof("---------------------------------------")
 }
 
+// logContainerConfig logs the full config we'll create the container with,
+// at debug level, with secrets redacted.
+func (exec *sidecarExecutor) logContainerConfig(opts *docker.CreateContainerOptions) {
+	if !log.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+
+	// Copy what we change, so we don't redact the real config
+	redacted := *opts
+	if opts.Config != nil {
+		config := *opts.Config
+		config.Env = make([]string, 0, len(opts.Config.Env))
+		for _, setting := range opts.Config.Env {
+			config.Env = append(config.Env, redactSetting(setting, exec.config.RedactEnvPatterns))
+		}
+		redacted.Config = &config
+	}
+
+	jsonConfig, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		log.Debugf("Unable to marshal container config: %s", err)
+		return
+	}
+
+	log.Debugf("Container config:\n%s", jsonConfig)
+}
+
 var replExpr = regexp.MustCompile("(.*)=(...).{10}(.+).{5}")
 
-// redactSettings will redact some things we don't want to log
-func redactSetting(setting string) string {
-	if strings.Contains(setting, "SECRET") {
+// DefaultRedactPatterns match the env vars we redact when no patterns were
+// configured
+var DefaultRedactPatterns = []string{"*SECRET*", "*PASSWORD*", "*_TOKEN"}
+
+// redactSetting masks the value of an env var setting ("NAME=value") whose
+// name matches one of the patterns. Everything that logs the container env
+// goes through here. Long values keep a few characters from each end, so
+// that we can tell which secret was used.
+func redactSetting(setting string, patterns []string) string {
+	name := strings.SplitN(setting, "=", 2)[0]
+	if !shouldRedact(name, patterns) {
+		return setting
+	}
+
+	if replExpr.MatchString(setting) {
 		return replExpr.ReplaceAllString(setting, "$1=$2[REDACTED]$3...")
 	}
-	return setting
+
+	return name + "=[REDACTED]"
+}
+
+// shouldRedact reports whether the env var name matches one of the glob
+// patterns, ignoring case. With no patterns, the defaults apply.
+func shouldRedact(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		patterns = DefaultRedactPatterns
+	}
+
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToUpper(pattern), strings.ToUpper(name))
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Send task status updates to Mesos via the executor driver
 func (exec *sidecarExecutor) sendStatus(status int64, taskID *mesos.TaskID) {
-	update := exec.driver.NewStatus(*taskID)
+	exec.sendStatusMessage(status, taskID, "")
+}
 
+// taskState maps our task statuses to Mesos task states
+func taskState(status int64) *mesos.TaskState {
 	switch status {
 	case TaskRunning:
-		update.State = mesos.TASK_RUNNING.Enum()
+		return mesos.TASK_RUNNING.Enum()
 	case TaskFinished:
-		update.State = mesos.TASK_FINISHED.Enum()
+		return mesos.TASK_FINISHED.Enum()
 	case TaskFailed:
-		update.State = mesos.TASK_FAILED.Enum()
+		return mesos.TASK_FAILED.Enum()
 	case TaskKilled:
-		update.State = mesos.TASK_KILLED.Enum()
+		return mesos.TASK_KILLED.Enum()
+	case TaskKilling:
+		return mesos.TASK_KILLING.Enum()
+	case TaskError:
+		return mesos.TASK_ERROR.Enum()
+	}
+	return nil
+}
+
+// sendStatusMessage sends a task status update to Mesos, with a message
+// explaining it, if we have one.
+func (exec *sidecarExecutor) sendStatusMessage(status int64, taskID *mesos.TaskID, message string) {
+	exec.sendStatusUpdate(status, taskID, message, nil)
+}
+
+// sendStatusUpdate sends a task status update to Mesos, with a message and
+// labels, if we have them.
+func (exec *sidecarExecutor) sendStatusUpdate(status int64, taskID *mesos.TaskID,
+	message string, labels []mesos.Label) {
+
+	update := exec.driver.NewStatus(*taskID)
+	update.State = taskState(status)
+
+	if message != "" {
+		update.Message = &message
+	}
+
+	if len(labels) > 0 {
+		update.Labels = &mesos.Labels{Labels: labels}
 	}
 
 	if err := exec.driver.SendStatusUpdate(update); err != nil {
@@ -123,34 +361,105 @@ func (exec *sidecarExecutor) sendStatus(status int64, taskID *mesos.TaskID) {
 	}
 }
 
-// Tell Mesos and thus the framework that the task finished. Shutdown driver.
-func (exec *sidecarExecutor) finishTask(taskInfo *mesos.TaskInfo) {
-	taskID := taskInfo.GetTaskID()
-	exec.sendStatus(TaskFinished, &taskID)
+// statusLabels returns the labels for the task's final status. Schedulers can
+// use the reason code and exit code to decide, e.g., whether to retry the
+// task, without parsing the message.
+func (exec *sidecarExecutor) statusLabels(reason EndReason) []mesos.Label {
+	var labels []mesos.Label
 
-	// Unfortunately the status updates are sent async and we can't
-	// get a handle on the channel used to send them. So we wait
-	time.Sleep(exec.statusSleepTime)
+	if reason != ReasonNone {
+		reasonCode := string(reason)
+		labels = append(labels, mesos.Label{Key: "ReasonCode", Value: &reasonCode})
+	}
 
-	exec.StopDriver()
+	// We may have failed before we even got a container
+	if exec.containerID != "" {
+		inspect, err := exec.client.InspectContainer(exec.containerID)
+		if err == nil {
+			exitCode := strconv.Itoa(inspect.State.ExitCode)
+			labels = append(labels, mesos.Label{Key: "ExitCode", Value: &exitCode})
+		}
+	}
+
+	return labels
 }
 
-// Tell Mesos and thus the framework that the task failed. Shutdown driver.
-func (exec *sidecarExecutor) failTask(taskInfo *mesos.TaskInfo) {
-	taskID := taskInfo.GetTaskID()
-	exec.sendStatus(TaskFailed, &taskID)
+// logTaskSummary logs a single line summing up how the task ended, so that
+// operators don't have to piece it together from the rest of the logs.
+func (exec *sidecarExecutor) logTaskSummary(status int64, taskInfo *mesos.TaskInfo, reason EndReason, message string) {
+	fields := log.Fields{
+		"TaskID":        taskInfo.TaskID.Value,
+		"Status":        taskState(status).String(),
+		"SidecarStatus": exec.lastSidecarStatus,
+		"Reason":        message,
+		"ReasonCode":    string(reason),
+	}
 
-	// Unfortunately the status updates are sent async and we can't
-	// get a handle on the channel used to send them. So we wait
-	time.Sleep(exec.statusSleepTime)
+	if fields["Reason"] == "" {
+		fields["Reason"] = "none given"
+	}
 
-	exec.StopDriver()
+	if fields["ReasonCode"] == "" {
+		fields["ReasonCode"] = "none"
+	}
+
+	if fields["SidecarStatus"] == "" {
+		fields["SidecarStatus"] = "unknown"
+	}
+
+	if !exec.healthyAt.IsZero() {
+		fields["TimeToHealthy"] = exec.timeToHealthy().String()
+	}
+
+	// We may have failed before we even got a container
+	if exec.containerID != "" {
+		fields["ContainerID"] = exec.containerID
+
+		inspect, err := exec.client.InspectContainer(exec.containerID)
+		if err != nil {
+			log.Warnf("Unable to inspect container for task summary: %s", err)
+		} else {
+			fields["ExitCode"] = inspect.State.ExitCode
+
+			finishedAt := inspect.State.FinishedAt
+			if finishedAt.IsZero() {
+				finishedAt = time.Now()
+			}
+			if !inspect.State.StartedAt.IsZero() {
+				fields["Duration"] = finishedAt.Sub(inspect.State.StartedAt).String()
+			}
+		}
+	}
+
+	log.WithFields(fields).Info("Task summary")
+}
+
+// Tell Mesos and thus the framework that the task finished. Shutdown driver.
+func (exec *sidecarExecutor) finishTask(taskInfo *mesos.TaskInfo) {
+	exec.endTask(TaskFinished, taskInfo, ReasonNone, "")
 }
 
-// taskKilled tells Mesos and the framework that the task was killed. Shutdown driver.
-func (exec *sidecarExecutor) taskKilled(taskInfo *mesos.TaskInfo) {
+// Tell Mesos and thus the framework that the task failed. Shutdown driver.
+func (exec *sidecarExecutor) failTask(taskInfo *mesos.TaskInfo, reason EndReason) {
+	exec.endTask(TaskFailed, taskInfo, reason, "")
+}
+
+// Tell Mesos and thus the framework that the task couldn't be launched because
+// its config is invalid. Unlike failTask, retrying won't help, and schedulers
+// can tell the difference. Shutdown driver.
+func (exec *sidecarExecutor) errorTask(taskInfo *mesos.TaskInfo, message string) {
+	exec.endTask(TaskError, taskInfo, ReasonInvalidConfig, message)
+}
+
+// endTask sends the final status for the task, with the reason and an
+// optional message, and then shuts down the driver.
+func (exec *sidecarExecutor) endTask(status int64, taskInfo *mesos.TaskInfo, reason EndReason, message string) {
 	taskID := taskInfo.GetTaskID()
-	exec.sendStatus(TaskKilled, &taskID)
+	exec.logTaskSummary(status, taskInfo, reason, message)
+	exec.sendStatusUpdate(status, &taskID, statusMessage(reason, message), exec.statusLabels(reason))
+
+	// Clean up after the container before the driver goes away
+	exec.runPostStopHook(status, taskInfo)
 
 	// Unfortunately the status updates are sent async and we can't
 	// get a handle on the channel used to send them. So we wait
@@ -159,86 +468,147 @@ func (exec *sidecarExecutor) taskKilled(taskInfo *mesos.TaskInfo) {
 	exec.StopDriver()
 }
 
-// Lookup a container in a service list
-func sidecarLookup(containerId string, services SidecarServices) (*service.Service, bool) {
-	hostname := os.Getenv("TASK_HOST") // Mesos supplies this
-	if _, ok := services.Servers[hostname]; !ok {
-		// Don't even have this host!
-		log.Warnf("Host not found in Sidecar, can't manage this container! (%s)", hostname)
-		return nil, ok
+// statusMessage prefixes the message with the reason code, if there is one
+func statusMessage(reason EndReason, message string) string {
+	switch {
+	case reason == ReasonNone:
+		return message
+	case message == "":
+		return string(reason)
+	default:
+		return string(reason) + ": " + message
 	}
+}
 
-	svc, ok := services.Servers[hostname].Services[containerId[:12]]
+// sidecarServiceId returns the key Sidecar uses for the container. Sidecar
+// versions differ in how much of the container ID they use, so this is
+// configurable. An idLength of 0 means the full ID.
+func sidecarServiceId(containerId string, idLength int) string {
+	if idLength <= 0 || idLength >= len(containerId) {
+		return containerId
+	}
 
-	return &svc, ok
+	return containerId[:idLength]
 }
 
 // We only want to kill things that are definitely unhealthy
-func shouldBeKilled(svc *service.Service) bool {
-	return svc.Status == service.UNHEALTHY || svc.Status == service.TOMBSTONE
+func shouldBeKilled(status int) bool {
+	return status == service.UNHEALTHY || status == service.TOMBSTONE
+}
+
+// discoveryTimedOut reports whether Sidecar has had longer than the discovery
+// timeout to find our service, and still hasn't. Once found, the service may
+// go missing again without failing the task.
+func (exec *sidecarExecutor) discoveryTimedOut() bool {
+	if exec.config.SidecarDiscoveryTimeout <= 0 || exec.discovered || exec.checksStartedAt.IsZero() {
+		return false
+	}
+
+	return time.Since(exec.checksStartedAt) > exec.config.SidecarDiscoveryTimeout
 }
 
 func (exec *sidecarExecutor) exceededFailCount() bool {
 	return exec.failCount >= exec.config.SidecarMaxFails
 }
 
-// Validate the status of this task with Sidecar
-func (exec *sidecarExecutor) sidecarStatus(containerId string) error {
-	fetch := func() ([]byte, error) {
-		resp, err := exec.fetcher.Get(exec.config.SidecarUrl)
-		if err != nil {
-			return nil, err
-		}
-		defer resp.Body.Close()
-
-		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			return nil, err
-		}
+// sidecarClient returns the client we check health with. Unless one was
+// injected, we talk to Sidecar over HTTP.
+func (exec *sidecarExecutor) sidecarClient(quiet bool) SidecarClient {
+	if exec.sidecar != nil {
+		return exec.sidecar
+	}
 
-		return body, nil
+	return &httpSidecarClient{
+		fetcher: exec.fetcher, config: exec.config, quiet: quiet, cache: &exec.sidecarState,
 	}
+}
 
-	// Try to connect to Sidecar, with some retries
-	var err error
-	var data []byte
-	for i := 0; i <= exec.config.SidecarRetryCount; i++ {
-		data, err = fetch()
-		if err == nil {
-			break
-		}
+// checkServiceHealth asks Sidecar for the service's health. When configured
+// to, we ask again a few times while Sidecar reports the status as UNKNOWN.
+func (exec *sidecarExecutor) checkServiceHealth(containerId string, quiet bool) (int, error) {
+	client := exec.sidecarClient(quiet)
+
+	status, err := client.CheckServiceHealth(containerId, os.Getenv("TASK_HOST"))
+	if exec.config.SidecarOnUnknown != "retry" {
+		return status, err
+	}
 
-		log.Warnf("Failed %d attempts to fetch state from Sidecar!", i+1)
+	for i := 0; i < exec.config.SidecarRetryCount && err == nil && status == service.UNKNOWN; i++ {
+		loghooks.LogRetry("sidecar-unknown", i+1, exec.config.SidecarRetryCount+1,
+			exec.config.SidecarRetryDelay, errors.New("Sidecar status is UNKNOWN"))
 		time.Sleep(exec.config.SidecarRetryDelay)
+
+		status, err = client.CheckServiceHealth(containerId, os.Getenv("TASK_HOST"))
 	}
 
+	return status, err
+}
+
+// Validate the status of this task with Sidecar
+func (exec *sidecarExecutor) sidecarStatus(containerId string) error {
+	// When Sidecar has been down for a while, we only log about it
+	// occasionally, or we flood the logs.
+	logDown := exec.sidecarDownCount == 0 || (exec.sidecarDownCount+1)%SidecarDownLogEvery == 0
+
+	status, err := exec.checkServiceHealth(containerId, !logDown)
+
 	// We really really don't want to shut off all the jobs if Sidecar
 	// is down. That would make it impossible to deploy Sidecar, and
 	// would make the entire system dependent on it for services to
 	// even start.
-	if err != nil {
-		log.Error("Can't contact Sidecar! Assuming healthy...")
-		return nil
+	if errors.Is(err, errSidecarUnreachable) {
+		exec.sidecarDownCount += 1
+		if logDown {
+			log.Errorf("Can't contact Sidecar! %s... (%d checks so far)",
+				exec.assumedStatus(), exec.sidecarDownCount)
+		}
+		return exec.sidecarUnavailable(containerId)
 	}
 
-	// We got a successful result from Sidecar, so let's parse it!
-	var services SidecarServices
-	err = json.Unmarshal(data, &services)
-	if err != nil {
-		log.Error("Can't parse Sidecar results! Assuming healthy...")
-		return nil
+	if exec.sidecarDownCount > 0 {
+		log.Infof("Sidecar is reachable again after %d failed checks", exec.sidecarDownCount)
+		exec.sidecarDownCount = 0
 	}
 
-	svc, ok := sidecarLookup(containerId, services)
-	if !ok {
+	if errors.Is(err, errServiceNotFound) {
+		if exec.discoveryTimedOut() {
+			log.Errorf("Service not found in Sidecar within %s, failing task!",
+				exec.config.SidecarDiscoveryTimeout)
+			return errNotDiscovered
+		}
+
 		log.Errorf("Can't find this service in Sidecar yet! Assuming healthy...")
 		return nil
 	}
 
+	if err != nil {
+		log.Errorf("%s. %s...", err, exec.assumedStatus())
+		return exec.sidecarUnavailable(containerId)
+	}
+	exec.discovered = true
+
+	exec.lastSidecarStatus = service.StatusString(status)
+	exec.health.update(func(s *healthState) { s.sidecarStatus = exec.lastSidecarStatus })
+
+	// Sidecar couldn't make up its mind, even after we asked again
+	if status == service.UNKNOWN && exec.config.SidecarOnUnknown == "retry" {
+		log.Errorf("Sidecar status still UNKNOWN after %d retries. %s...",
+			exec.config.SidecarRetryCount, exec.assumedStatus())
+		return exec.sidecarUnavailable(containerId)
+	}
+
 	// This is the one and only place where we're going to raise our hand
 	// and say something is wrong with this service and it needs to be
 	// shot by Mesos.
-	if shouldBeKilled(svc) {
+	if shouldBeKilled(status) || (status == service.UNKNOWN && exec.config.SidecarOnUnknown == "unhealthy") {
+		// When draining we're going away anyway, so don't shoot the container
+		if exec.isDraining() {
+			log.Warnf("Failed Sidecar health check while draining, ignoring")
+			return nil
+		}
+
+		exec.successCount = 0
+
 		// Only bail out if we've exceed the setting for number of failures
 		if !exec.exceededFailCount() {
 			exec.failCount += 1
@@ -249,60 +619,306 @@ func (exec *sidecarExecutor) sidecarStatus(containerId string) error {
 		log.Errorf("Health failure count exceeded %d", exec.config.SidecarMaxFails)
 
 		exec.failCount = 0
-		return errors.New("Unhealthy container: " + containerId + " failing task!")
+
+		if exec.shouldRestart() {
+			return exec.restartContainer(containerId)
+		}
+
+		return &unhealthyError{containerId: containerId, status: status}
 	}
 
 	exec.failCount = 0 // Reset because we were healthy!
 
+	// Services that blip healthy while booting only count as healthy once
+	// they've passed enough checks in a row
+	if status != service.ALIVE {
+		exec.successCount = 0
+		return nil
+	}
+
+	exec.successCount += 1
+	if exec.successCount >= exec.config.SidecarSuccessThreshold {
+		exec.recordHealthy()
+	}
+
+	return nil
+}
+
+// recordHealthy notes the first time Sidecar reports the service as healthy,
+// SidecarSuccessThreshold checks in a row, and logs how long after launch
+// that was.
+func (exec *sidecarExecutor) recordHealthy() {
+	if !exec.healthyAt.IsZero() || exec.startedAt.IsZero() {
+		return
+	}
+
+	exec.healthyAt = time.Now()
+	exec.health.update(func(s *healthState) { s.healthyAt = exec.healthyAt })
+	close(exec.healthyChan)
+
+	log.WithFields(log.Fields{
+		"TimeToHealthy": exec.timeToHealthy().String(),
+	}).Info("Service became healthy in Sidecar")
+}
+
+// timeToHealthy returns how long after launch the service first became
+// healthy. It's zero if it hasn't yet.
+func (exec *sidecarExecutor) timeToHealthy() time.Duration {
+	if exec.healthyAt.IsZero() {
+		return 0
+	}
+
+	return exec.healthyAt.Sub(exec.startedAt)
+}
+
+// assumedStatus describes what we assume when Sidecar can't give us a status
+func (exec *sidecarExecutor) assumedStatus() string {
+	if exec.critical {
+		return "Critical task, assuming unhealthy"
+	}
+	return "Assuming healthy"
+}
+
+// sidecarUnavailable handles a check where we couldn't get a status from
+// Sidecar. Normally we assume the service is healthy. But for critical tasks
+// it counts as a failed health check, and we fail the task once we've
+// exceeded SidecarMaxFails.
+func (exec *sidecarExecutor) sidecarUnavailable(containerId string) error {
+	if !exec.critical || exec.isDraining() {
+		return nil
+	}
+
+	if !exec.exceededFailCount() {
+		exec.failCount += 1
+		return nil
+	}
+
+	log.Errorf("Health failure count exceeded %d", exec.config.SidecarMaxFails)
+	exec.failCount = 0
+
+	return fmt.Errorf("%w: %s is critical and Sidecar is unavailable, failing task!",
+		errUnhealthy, containerId)
+}
+
+// shouldRestart reports whether an unhealthy container should get an in-place
+// restart rather than failing the task.
+func (exec *sidecarExecutor) shouldRestart() bool {
+	if !exec.config.RestartOnUnhealthy || exec.restarted || exec.observeOnly {
+		return false
+	}
+
+	if exec.config.AutoRemove {
+		log.Warn("Can't restart an auto-removed container, not restarting")
+		return false
+	}
+
+	return true
+}
+
+// restartContainer stops and starts the same container, to give an unhealthy
+// service one more chance before we fail the task. We only do this once.
+func (exec *sidecarExecutor) restartContainer(containerId string) error {
+	exec.restarted = true
+
+	log.Warnf("Restarting unhealthy container %s in place", containerId)
+
+	err := container.StopContainer(exec.client, containerId, exec.config.KillTaskTimeout)
+	if err != nil {
+		return fmt.Errorf("Unable to stop unhealthy container %s for restart: %s", containerId, err)
+	}
+
+	err = exec.client.StartContainer(containerId, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to restart unhealthy container %s: %s", containerId, err)
+	}
+
 	return nil
 }
 
+// newWatchLooper returns the looper that drives the container health checks.
+func (exec *sidecarExecutor) newWatchLooper() director.Looper {
+	return director.NewImmediateTimedLooper(
+		director.FOREVER,
+		exec.config.SidecarPollInterval,
+		make(chan error),
+	)
+}
+
+// pollJitter returns a random delay of up to SidecarPollJitter to add to the
+// interval between health checks.
+func (exec *sidecarExecutor) pollJitter() time.Duration {
+	if exec.config.SidecarPollJitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(exec.config.SidecarPollJitter) + 1))
+}
+
+// newTaskContext returns the context for watching a task. Cancelling it, when
+// the task is killed or drained, or we get a signal, stops the health checks,
+// the readiness probe, and the log relay.
+func (exec *sidecarExecutor) newTaskContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	exec.cancelTask = cancel
+
+	return ctx
+}
+
+// stopWatching stops watching the task, which reports its status once the
+// monitor sees the container has gone. Without a task context, e.g. before
+// the task was launched, we just quit the looper.
+func (exec *sidecarExecutor) stopWatching() {
+	if exec.cancelTask != nil {
+		exec.cancelTask()
+		return
+	}
+
+	exec.watchLooper.Quit()
+}
+
+// watchContainer starts monitoring the container and relaying its logs, until
+// the context is cancelled. The watchLooper must already have been set up.
+func (exec *sidecarExecutor) watchContainer(ctx context.Context, containerId string,
+	taskInfo *mesos.TaskInfo, labels map[string]string) {
+
+	exec.startedAt = time.Now()
+	exec.health.update(func(s *healthState) { s.startedAt = exec.startedAt })
+	exec.critical = criticalTask(labels)
+	exec.taskLabels = mesosLabelsForTask(taskInfo)
+	exec.checkContainer = labels["executor.SidecarContainer"]
+
+	// Docker will remove the container as soon as it exits, and then we
+	// can't inspect it for the exit code. So we have to wait on it instead.
+	if exec.config.AutoRemove {
+		exec.exitChan = make(chan exitResult, 1)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Recovered from panic while waiting on the container: %v\n%s", r, debug.Stack())
+					exec.exitChan <- exitResult{StillRunning, fmt.Errorf("%w: %v", errPanicked, r)}
+				}
+			}()
+
+			code, err := exec.client.WaitContainer(containerId)
+			exec.exitChan <- exitResult{code, err}
+		}()
+	}
+
+	// We have to do this in a different goroutine or the scheduler
+	// can't send us any further updates.
+	go exec.monitorTask(
+		ctx, containerId, taskInfo, shouldCheckSidecar(exec.containerConfig),
+	)
+
+	// We may be responsible for log relaying. Handle, if we are.
+	exec.handleContainerLogs(ctx, containerId, labels)
+}
+
 // monitorTask runs in a goroutine and hangs out, waiting for the watchLooper to
 // complete. When it completes, it handles the Docker and Mesos interactions.
-func (exec *sidecarExecutor) monitorTask(cntnrId string, taskInfo *mesos.TaskInfo, checkSidecar bool) {
+// Cancelling the context quits the looper, just like Quit() does.
+func (exec *sidecarExecutor) monitorTask(ctx context.Context, cntnrId string,
+	taskInfo *mesos.TaskInfo, checkSidecar bool) {
+
+	defer exec.recoverPanic(taskInfo)
+
 	log.Infof("Monitoring Mesos task %s for container %s [checkSidecar: %t]",
 		taskInfo.TaskID.Value, cntnrId[:12], checkSidecar,
 	)
 
-	// Wait for Sidecar backoff interval
-	if checkSidecar {
-		time.Sleep(exec.config.SidecarBackoff)
+	// Wait for Sidecar backoff interval, unless the service starts fast
+	// enough that we were asked to check straight away
+	if checkSidecar && !exec.config.SidecarImmediateCheck {
+		select {
+		case <-time.After(exec.config.SidecarBackoff):
+		case <-ctx.Done():
+		}
+	}
+
+	// Don't start counting health checks while Docker says it's still
+	// booting
+	if checkSidecar && exec.config.SidecarWaitDockerHealth {
+		exec.waitForDockerHealth(ctx, cntnrId)
 	}
+	exec.checksStartedAt = time.Now()
 
 	// watcherWg is used to let the Sidecar draining exit early if the
 	// container exits, and when shutting down from the signal handler.
 	exec.watcherWg.Add(1)
-
-	containerName := container.GetContainerName(&taskInfo.TaskID)
+	defer exec.watcherWg.Done()
 
 	// Note that because of the way the retries work, the loop timing is a
 	// lower bound on the delay.
 	var exitCode int = StillRunning
-	go exec.watchLooper.Loop(func() error {
-		var err error
-		exitCode, err = exec.checkContainerStatus(cntnrId, checkSidecar)
-		return err
+	go exec.watchLooper.Loop(func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("Recovered from panic while checking the container: %v\n%s", r, debug.Stack())
+				err = fmt.Errorf("%w: %v", errPanicked, r)
+			}
+		}()
+
+		// Spread out the checks from executors started at the same time
+		select {
+		case <-time.After(exec.pollJitter()):
+		case <-ctx.Done():
+		}
+
+		exitCode, err = exec.checkContainerStatus(ctx, cntnrId, checkSidecar)
+		return exec.tolerateDockerError(err)
 	})
 
-	err := exec.watchLooper.Wait()
+	// Quit the looper if we're cancelled while it's still running
+	watchDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			exec.watchLooper.Quit()
+		case <-watchDone:
+		}
+	}()
 
-	if err != nil {
-		log.Errorf("Error! %s", err)
+	watchErr := exec.watchLooper.Wait()
+	close(watchDone)
+
+	// We're done one way or another, so the deadline no longer applies
+	if exec.deadlineTimer != nil {
+		exec.deadlineTimer.Stop()
+	}
+
+	if watchErr != nil {
+		log.Errorf("Error! %s", watchErr)
+	}
+
+	// We were only watching, so the container carries on without us
+	if exitCode == StillRunning && exec.observeOnly {
+		log.Infof("Stopped watching container %s, leaving it running", cntnrId)
+		if watchErr != nil {
+			exec.endTask(TaskFailed, taskInfo, exec.taskEndReason(watchErr, 0, false), watchErr.Error())
+		} else {
+			exec.finishTask(taskInfo)
+		}
+		return
+	}
+
+	if errors.Is(watchErr, errUnhealthy) && exec.config.OnUnhealthy == "pause" {
+		exec.pauseUnhealthy(ctx, cntnrId, taskInfo, watchErr)
 	}
 
 	if exitCode == StillRunning {
 		// Something went wrong, we better take this thing out!
 		err := container.StopContainer(
-			exec.client, containerName, exec.config.KillTaskTimeout,
+			exec.client, cntnrId, exec.config.KillTaskTimeout,
 		)
 		if err != nil {
-			log.Errorf("Error stopping container %s! %s", containerName, err)
+			log.Errorf("Error stopping container %s! %s", cntnrId, err)
 		}
 	}
 
 	// We have to check one more time if it still reports as running
+	var err error
 	if exitCode == StillRunning {
-		exitCode, err = exec.checkContainerStatus(cntnrId, checkSidecar)
+		exitCode, err = exec.checkContainerStatus(ctx, cntnrId, checkSidecar)
 		if err != nil {
 			log.Error("Unable to check container status! Assuming dead, moving on.")
 		}
@@ -315,38 +931,247 @@ func (exec *sidecarExecutor) monitorTask(cntnrId string, taskInfo *mesos.TaskInf
 		log.Error(err.Error())
 	}
 
-	exec.handleContainerExit(taskInfo, exitCode)
+	exec.handleContainerExit(cntnrId, taskInfo, exitCode, watchErr)
+}
+
+// pauseUnhealthy pauses a container that failed its health checks, rather
+// than stopping it, so that someone can inspect it. The task stays RUNNING
+// until it's killed, and then we unpause the container to stop it as usual.
+// If we can't pause it, we just carry on and stop it.
+func (exec *sidecarExecutor) pauseUnhealthy(ctx context.Context, containerId string,
+	taskInfo *mesos.TaskInfo, watchErr error) {
+
+	err := exec.client.PauseContainer(containerId)
+	if err != nil {
+		log.Errorf("Unable to pause unhealthy container %s, stopping it instead: %s", containerId, err)
+		return
+	}
+	exec.paused = true
+
+	taskID := taskInfo.GetTaskID()
+	message := fmt.Sprintf("Container paused for debugging. %s", watchErr)
+	log.Warn(message)
+	exec.sendStatusMessage(TaskRunning, &taskID, message)
+
+	<-ctx.Done()
+	exec.unpauseContainer(containerId)
+}
+
+// unpauseContainer unpauses the container if we paused it, since Docker
+// won't stop a paused container.
+func (exec *sidecarExecutor) unpauseContainer(containerId string) {
+	if !exec.paused {
+		return
+	}
 
-	// Release any goroutines waiting for the watcher to complete
-	exec.watcherWg.Done()
+	err := exec.client.UnpauseContainer(containerId)
+	if err != nil {
+		log.Errorf("Unable to unpause container %s! %s", containerId, err)
+		return
+	}
+	exec.paused = false
 }
 
-func (exec *sidecarExecutor) handleContainerExit(taskInfo *mesos.TaskInfo, exitCode int) {
+// waitForDockerHealth waits until Docker reports the container as healthy by
+// its own HEALTHCHECK. We stop waiting if the image has no health check, if
+// it goes unhealthy, or if the container stops, and leave it to the usual
+// checks from there.
+func (exec *sidecarExecutor) waitForDockerHealth(ctx context.Context, containerId string) {
+	log.Info("Waiting for Docker to report the container as healthy")
+
+	for {
+		inspect, err := exec.client.InspectContainer(containerId)
+		if err != nil {
+			log.Warnf("Unable to get the Docker health of %s, not waiting: %s", containerId, err)
+			return
+		}
+
+		status := inspect.State.Health.Status
+		switch {
+		case !inspect.State.Running:
+			log.Warnf("Container %s stopped while waiting for it to be healthy", containerId)
+			return
+		case status == "":
+			log.Info("Container has no Docker health check, not waiting for it")
+			return
+		case status != "starting":
+			log.Infof("Docker reports the container as %s", status)
+			return
+		}
+
+		select {
+		case <-time.After(exec.config.DockerHealthInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recoverPanic is deferred in the goroutines that watch the task. Without it,
+// a panic there would leave the task hanging with no status update. Instead
+// we log it and fail the task.
+func (exec *sidecarExecutor) recoverPanic(taskInfo *mesos.TaskInfo) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	log.Errorf("Recovered from panic while monitoring the task: %v\n%s", r, debug.Stack())
+	exec.endTask(TaskFailed, taskInfo, ReasonPanic, fmt.Sprintf("%s: %v", errPanicked, r))
+}
+
+func (exec *sidecarExecutor) handleContainerExit(containerId string, taskInfo *mesos.TaskInfo,
+	exitCode int, watchErr error) {
+
+	exec.exitCode = exitCode
+	exec.containerExited = true
+
 	// On failed/killed tasks, we want to grab the logs and play them into Mesos
+	var oomKilled bool
 	if exitCode != 0 {
-		containerName := container.GetContainerName(&taskInfo.TaskID)
 		// Copy the failure logs (hopefully) to stdout/stderr so we can get them
-		exec.copyLogs(containerName)
+		exec.copyLogs(containerId)
+
+		// Show what it left behind on disk, for forensics
+		if exec.config.CaptureFsChanges {
+			exec.logFsChanges(containerId)
+		}
+
+		oomKilled = container.WasOOMKilled(exec.client, containerId)
 	}
 
+	reason := exec.taskEndReason(watchErr, exitCode, oomKilled)
+
 	switch {
+	// We stopped the container ourselves, so the exit code won't tell the
+	// real story.
+	case errors.Is(watchErr, errNotReady):
+		log.Error("Task never became ready, notifying Mesos")
+		exec.failTask(taskInfo, reason)
+	case errors.Is(watchErr, errDeadlineExceeded):
+		log.Error("Task exceeded its max runtime, notifying Mesos")
+		exec.endTask(TaskKilled, taskInfo, reason, errDeadlineExceeded.Error())
+	case errors.Is(watchErr, errNotDiscovered):
+		log.Error("Task was never discovered by Sidecar, notifying Mesos")
+		exec.endTask(TaskFailed, taskInfo, reason, errNotDiscovered.Error())
+	case errors.Is(watchErr, errPanicked):
+		log.Error("Recovered from a panic, notifying Mesos")
+		exec.endTask(TaskFailed, taskInfo, reason, watchErr.Error())
+	// The kernel killed it for using too much memory. This would otherwise
+	// look like any other SIGKILL.
+	case oomKilled:
+		log.WithFields(log.Fields{
+			"TaskID":    taskInfo.TaskID.Value,
+			"OOMKilled": true,
+		}).Error("Task was OOM killed, notifying Mesos")
+		exec.endTask(TaskFailed, taskInfo, reason, "OOM killed")
+	// We shot it for failing its health checks. The error names the status
+	// Sidecar reported.
+	case errors.Is(watchErr, errUnhealthy):
+		log.Error("Task failed its health checks, notifying Mesos")
+		exec.endTask(TaskFailed, taskInfo, reason, watchErr.Error())
+	// Mesos asked for it, so however it exited, it was killed
+	case exec.killRequested:
+		log.Info("Task was killed as requested, notifying Mesos")
+		exec.endTask(TaskKilled, taskInfo, reason, exec.hardKillMessage())
 	// Posix exit codes signifiying that fatal signals where sent to the
 	// process. See https://www.tldp.org/LDP/abs/html/exitcodes.html
 	case exitCode > 128 && exitCode <= 165:
 		log.Error("Task was killed, notifying Mesos")
-		exec.taskKilled(taskInfo)
+		exec.endTask(TaskKilled, taskInfo, reason, exec.hardKillMessage())
 	case exitCode > 0: // Other error, non-specified
 		log.Error("Task failed, notifying Mesos")
-		exec.failTask(taskInfo)
+		exec.failTask(taskInfo, reason)
 	case exitCode < 0: // Special case: -1 unable to check code
 		log.Error("Task may still be running despite attempts to kill!")
-		exec.failTask(taskInfo)
+		exec.failTask(taskInfo, reason)
+	// A clean exit doesn't count as success if the task didn't stay up long
+	// enough for us to believe it actually did its job.
+	case exec.exitedTooSoon():
+		msg := fmt.Sprintf("Task exited after %s, before the minimum healthy duration of %s",
+			time.Since(exec.startedAt).Round(time.Millisecond), exec.config.MinHealthyDuration)
+		log.Error(msg)
+		exec.endTask(TaskFailed, taskInfo, reason, msg)
 	default:
 		log.Info("Task completed: ", taskInfo.GetName())
 		exec.finishTask(taskInfo)
 	}
 }
 
+// taskEndReason works out why the task ended, from the error that stopped the
+// watcher and how the container exited. The order matches the cases in
+// handleContainerExit.
+func (exec *sidecarExecutor) taskEndReason(watchErr error, exitCode int, oomKilled bool) EndReason {
+	switch {
+	case errors.Is(watchErr, errNotReady):
+		return ReasonNotReady
+	case errors.Is(watchErr, errDeadlineExceeded):
+		return ReasonDeadline
+	case errors.Is(watchErr, errNotDiscovered):
+		return ReasonDiscoveryTimeout
+	case errors.Is(watchErr, errPanicked):
+		return ReasonPanic
+	case oomKilled:
+		return ReasonOOM
+	// Tombstoned services are also unhealthy, so check for them first
+	case errors.Is(watchErr, errTombstone):
+		return ReasonTombstone
+	case errors.Is(watchErr, errUnhealthy):
+		return ReasonUnhealthy
+	case exec.killRequested:
+		return ReasonKilled
+	// We stopped it ourselves after the drain quiet period. It only timed
+	// out if it then didn't exit within KillTaskTimeout.
+	case exec.isDraining() && (exec.hardKilled || exec.forceRemoved):
+		return ReasonDrainingTimeout
+	case exec.isDraining():
+		return ReasonDraining
+	case exitCode != 0 || exec.exitedTooSoon():
+		return ReasonCrash
+	}
+
+	return ReasonNone
+}
+
+// hardKillMessage explains, for the final status, that we had to SIGKILL or
+// force remove the container. It's empty if we didn't.
+func (exec *sidecarExecutor) hardKillMessage() string {
+	if exec.forceRemoved {
+		return fmt.Sprintf("Container wouldn't stop within %ds and was force removed", exec.config.KillTaskTimeout)
+	}
+
+	if !exec.hardKilled {
+		return ""
+	}
+
+	return fmt.Sprintf("Container ignored SIGTERM and was killed after %ds", exec.config.KillTaskTimeout)
+}
+
+// exitedTooSoon reports whether the container exited before it had been
+// running for MinHealthyDuration.
+func (exec *sidecarExecutor) exitedTooSoon() bool {
+	if exec.config.MinHealthyDuration <= 0 || exec.startedAt.IsZero() {
+		return false
+	}
+
+	return time.Since(exec.startedAt) < exec.config.MinHealthyDuration
+}
+
+// processExitCode returns the code the executor should exit with. That's 0
+// unless we were asked to forward the container's exit code. If we couldn't
+// find that out, we exit with 1 so it doesn't look like success.
+func (exec *sidecarExecutor) processExitCode() int {
+	if !exec.config.ForwardExitCode {
+		return 0
+	}
+
+	if exec.exitCode < 0 {
+		return 1
+	}
+
+	return exec.exitCode
+}
+
 // maybeCleanupAWSCredsLease looks to see if we have stored any AWS creds from
 // startup time. If they are present, we will clean up the lease before
 // exiting, to help prevent garbage from building up in AWS IAM.
@@ -365,12 +1190,25 @@ func (exec *sidecarExecutor) maybeCleanupAWSCredsLease() {
 
 // checkContainerStatus is called on a timed basis and checks the health of the
 // process in Sidecar.
-func (exec *sidecarExecutor) checkContainerStatus(containerId string, checkSidecar bool) (int, error) {
-	containers, err := exec.client.ListContainers(
-		docker.ListContainersOptions{},
-	)
+func (exec *sidecarExecutor) checkContainerStatus(ctx context.Context, containerId string,
+	checkSidecar bool) (int, error) {
+
+	containers, err := exec.listContainers(ctx)
 	if err != nil {
-		return StillRunning, err
+		return StillRunning, fmt.Errorf("%w: %s", errDockerDaemon, err)
+	}
+
+	// The container may only be gone for a moment, e.g. while Docker restarts
+	// it, so we give it a chance to come back.
+	if !containerIsPresent(containers, containerId) && exec.config.MissingContainerGrace > 0 {
+		log.Warnf("Container %s not running, checking again in %s",
+			containerId, exec.config.MissingContainerGrace)
+		time.Sleep(exec.config.MissingContainerGrace)
+
+		containers, err = exec.listContainers(ctx)
+		if err != nil {
+			return StillRunning, fmt.Errorf("%w: %s", errDockerDaemon, err)
+		}
 	}
 
 	// Loop through all the running containers, looking for a running container
@@ -378,7 +1216,7 @@ func (exec *sidecarExecutor) checkContainerStatus(containerId string, checkSidec
 	if !containerIsPresent(containers, containerId) {
 		exec.watchLooper.Quit() // Will cause looper to exit on next iter
 
-		exitCode, err := container.GetExitCode(exec.client, containerId)
+		exitCode, err := exec.getExitCode(containerId)
 		if err != nil {
 			return StillRunning, err
 		}
@@ -396,6 +1234,159 @@ func (exec *sidecarExecutor) checkContainerStatus(containerId string, checkSidec
 	return StillRunning, exec.maybeCheckSidecar(containerId, checkSidecar)
 }
 
+// tolerateDockerError swallows up to DockerErrorRetries daemon errors from
+// consecutive health checks, so that a hiccup in Docker doesn't take the task
+// down. Any other result, good or bad, resets the count.
+func (exec *sidecarExecutor) tolerateDockerError(err error) error {
+	if !errors.Is(err, errDockerDaemon) {
+		exec.dockerErrorCount = 0
+		return err
+	}
+
+	exec.dockerErrorCount += 1
+	if exec.dockerErrorCount > exec.config.DockerErrorRetries {
+		return err
+	}
+
+	loghooks.LogRetry("docker", exec.dockerErrorCount, exec.config.DockerErrorRetries+1,
+		exec.config.SidecarPollInterval, err)
+	return nil
+}
+
+// listContainers lists the running containers. When Docker can't be reached,
+// e.g. because dockerd is restarting, we keep trying for up to
+// DockerReconnectTimeout, unless the task is stopped first. With
+// live-restore, the container survives the restart, so we carry on watching
+// it once Docker is back. An open circuit breaker has already given up on
+// Docker for its cooldown, so there's no point waiting on it here too.
+func (exec *sidecarExecutor) listContainers(ctx context.Context) ([]docker.APIContainers, error) {
+	containers, err := exec.client.ListContainers(docker.ListContainersOptions{})
+	if err == nil || exec.config.DockerReconnectTimeout <= 0 || errors.Is(err, container.ErrCircuitOpen) {
+		return containers, err
+	}
+
+	log.Warnf("Lost contact with Docker, waiting up to %s for it to come back: %s",
+		exec.config.DockerReconnectTimeout, err)
+
+	deadline := time.Now().Add(exec.config.DockerReconnectTimeout)
+	for attempt := 1; time.Now().Before(deadline); attempt++ {
+		loghooks.LogRetry("docker-reconnect", attempt, 0, exec.config.DockerReconnectDelay, err)
+		select {
+		case <-time.After(exec.config.DockerReconnectDelay):
+		case <-ctx.Done():
+			log.Warn("Stopped waiting for Docker, the task is being stopped")
+			return nil, err
+		}
+
+		containers, err = exec.client.ListContainers(docker.ListContainersOptions{})
+		if err == nil {
+			log.Info("Reconnected to Docker, carrying on watching the container")
+			return containers, nil
+		}
+		if errors.Is(err, container.ErrCircuitOpen) {
+			return nil, err
+		}
+	}
+
+	log.Errorf("Docker didn't come back within %s", exec.config.DockerReconnectTimeout)
+	return nil, err
+}
+
+// getExitCode returns the exit code for the container. If Docker auto-removed
+// the container, we use what we got from waiting on it.
+func (exec *sidecarExecutor) getExitCode(containerId string) (int, error) {
+	if exec.exitChan == nil {
+		return container.GetExitCode(exec.client, containerId)
+	}
+
+	select {
+	case result := <-exec.exitChan:
+		if result.err != nil {
+			return 0, fmt.Errorf("Unable to wait on container %s: %s", containerId, result.err)
+		}
+		return result.code, nil
+	case <-time.After(ExitCodeWaitTime):
+		return 0, fmt.Errorf("Timed out waiting for exit code from container %s", containerId)
+	}
+}
+
+// confirmRunning waits for the delay to pass and then tells Mesos the task is
+// running, but only if the container is still up. If it died in the mean
+// time, monitorTask() will report the failure instead. If we have a readiness
+// address, the container must also be accepting connections on it, or we fail
+// the task.
+func (exec *sidecarExecutor) confirmRunning(ctx context.Context, containerId string,
+	taskID *mesos.TaskID, delay time.Duration, readinessAddr string) {
+
+	if delay > 0 {
+		log.Infof("Delaying TASK_RUNNING for %s", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	containers, err := exec.client.ListContainers(docker.ListContainersOptions{})
+	if err != nil {
+		// Don't leave the task in limbo, the watcher will catch a real problem
+		log.Warnf("Unable to confirm container is running, sending TASK_RUNNING anyway: %s", err)
+		exec.sendStatus(TaskRunning, taskID)
+		return
+	}
+
+	if !containerIsPresent(containers, containerId) {
+		log.Warnf("Container %s exited within %s, not sending TASK_RUNNING", containerId, delay)
+		return
+	}
+
+	if readinessAddr != "" {
+		err := exec.probeReadiness(ctx, readinessAddr)
+		if ctx.Err() != nil {
+			// We're no longer watching the task, so there's nothing to report
+			return
+		}
+		if err != nil {
+			// Shut down the watcher, which will stop the container and fail the task
+			exec.watchLooper.Done(err)
+			return
+		}
+	}
+
+	exec.sendStatus(TaskRunning, taskID)
+}
+
+// probeReadiness tries to open a TCP connection to the address, with some
+// retries. Returns an error wrapping errNotReady if it never succeeds, or the
+// context's error if it was cancelled.
+func (exec *sidecarExecutor) probeReadiness(ctx context.Context, addr string) error {
+	log.Infof("Waiting for container to accept connections on %s", addr)
+
+	var err error
+	for i := 0; i <= exec.config.ReadinessRetryCount; i++ {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", addr, exec.config.ReadinessTimeout)
+		if err == nil {
+			conn.Close()
+			log.Infof("Container is accepting connections on %s", addr)
+			return nil
+		}
+
+		if i == exec.config.ReadinessRetryCount {
+			break
+		}
+
+		loghooks.LogRetry("readiness", i+1, exec.config.ReadinessRetryCount+1, exec.config.ReadinessRetryDelay, err)
+		select {
+		case <-time.After(exec.config.ReadinessRetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return fmt.Errorf("%w: unable to connect to %s: %s", errNotReady, addr, err)
+}
+
 // maybeCheckSidecar will get the container status from Sidecar if we're
 // configured to monitor it.
 func (exec *sidecarExecutor) maybeCheckSidecar(containerId string, checkSidecar bool) error {
@@ -404,7 +1395,33 @@ func (exec *sidecarExecutor) maybeCheckSidecar(containerId string, checkSidecar
 	}
 
 	// Validate health status with Sidecar
-	return exec.sidecarStatus(containerId)
+	return exec.sidecarStatus(exec.sidecarContainerId(containerId))
+}
+
+// sidecarContainerId returns the ID of the container whose service we check
+// in Sidecar. That's our own container, unless the task named another one
+// with the executor.SidecarContainer label, e.g. a proxy in front of it. We
+// look that one up by ID or name, since it may not have been started by us.
+// Until it's found, we use the label as it is.
+func (exec *sidecarExecutor) sidecarContainerId(containerId string) string {
+	if exec.checkContainer == "" {
+		return containerId
+	}
+
+	if exec.checkContainerID != "" {
+		return exec.checkContainerID
+	}
+
+	inspect, err := exec.client.InspectContainer(exec.checkContainer)
+	if err != nil {
+		log.Warnf("Unable to find Sidecar container %s, using it as the ID: %s", exec.checkContainer, err)
+		return exec.checkContainer
+	}
+
+	log.Infof("Checking the health of container %s in Sidecar, instead of %s", inspect.ID, containerId)
+	exec.checkContainerID = inspect.ID
+
+	return exec.checkContainerID
 }
 
 // containerIsPresent checks a list of container for the current container
@@ -434,7 +1451,7 @@ func (exec *sidecarExecutor) maybePullContainer(taskInfo *mesos.TaskInfo) error
 
 	// Pull the image if it's stale/missing or we're told to force it
 	if shouldPullContainer {
-		err := container.PullImage(exec.client, taskInfo, exec.dockerAuth)
+		err := container.PullImage(exec.client, taskInfo, exec.dockerAuth, exec.config.PullStallTimeout)
 		if err != nil {
 			return err
 		}
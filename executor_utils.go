@@ -1,19 +1,26 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Nitro/sidecar-executor/container"
+	"github.com/Nitro/sidecar-executor/loghooks"
 	"github.com/fsouza/go-dockerclient"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
 )
 
 // copyLogs will copy the Docker container logs to stdout and stderr so we can
@@ -27,12 +34,35 @@ func (exec *sidecarExecutor) copyLogs(containerId string) {
 	)
 }
 
+// logFsChanges logs a summary of what the container changed in its
+// filesystem, which can help work out why it failed. Only the first
+// MaxFsChanges paths are listed.
+func (exec *sidecarExecutor) logFsChanges(containerId string) {
+	changes, err := exec.client.ContainerChanges(containerId)
+	if err != nil {
+		log.Warnf("Unable to get filesystem changes for container %s: %s", containerId, err)
+		return
+	}
+
+	log.Infof("Filesystem changes --------------------")
+	for _, line := range container.SummarizeChanges(changes, MaxFsChanges) {
+		log.Infof(" * %s", line)
+	}
+	log.Infof("---------------------------------------")
+}
+
 // handleContainerLogs will, if configured to do it, watch and relay container
 // logs to syslog.
-func (exec *sidecarExecutor) handleContainerLogs(containerId string,
+func (exec *sidecarExecutor) handleContainerLogs(ctx context.Context, containerId string,
 	labels map[string]string) {
 
 	if exec.config.RelaySyslog || exec.config.RelaySyslogStartupOnly {
+		// Tasks that ship their own logs don't want them twice
+		if noLogRelay(labels) {
+			log.Info("Task has NoLogRelay set, not relaying its logs")
+			return
+		}
+
 		var output io.Writer
 		if exec.config.ContainerLogsStdout {
 			output = os.Stdout
@@ -40,8 +70,44 @@ func (exec *sidecarExecutor) handleContainerLogs(containerId string,
 			output = ioutil.Discard
 		}
 
-		exec.logsQuitChan = make(chan struct{})
-		go exec.relayLogs(exec.logsQuitChan, containerId, labels, output)
+		go exec.relayLogs(ctx, containerId, labels, output)
+	}
+}
+
+// newHttpClient returns the client we use to talk to Sidecar and Mesos. It
+// honors HTTP_PROXY, HTTPS_PROXY, and NO_PROXY from the environment. Requests
+// to localhost never go through the proxy. Since we poll Sidecar frequently,
+// connections are kept alive and reused between checks.
+func newHttpClient(config Config) *http.Client {
+	proxyFunc := httpproxy.FromEnvironment().ProxyFunc()
+
+	return &http.Client{
+		Timeout: config.HttpTimeout,
+		Transport: &http.Transport{
+			Proxy: func(req *http.Request) (*url.URL, error) {
+				return proxyFunc(req.URL)
+			},
+			DialContext:         newHttpDialer(config).DialContext,
+			MaxIdleConns:        config.HttpMaxIdleConns,
+			MaxIdleConnsPerHost: config.HttpMaxIdleConns,
+			IdleConnTimeout:     config.HttpIdleConnTimeout,
+		},
+	}
+}
+
+// newHttpDialer returns the dialer for newHttpClient. HttpKeepAlive only sets
+// the TCP keep-alive probes. Reusing connections is up to the transport.
+func newHttpDialer(config Config) *net.Dialer {
+	// The dialer takes zero to mean its default interval, and negative to
+	// mean no probes at all
+	keepAlive := config.HttpKeepAlive
+	if keepAlive == 0 {
+		keepAlive = -1
+	}
+
+	return &net.Dialer{
+		Timeout:   config.HttpTimeout,
+		KeepAlive: keepAlive,
 	}
 }
 
@@ -151,8 +217,8 @@ func (exec *sidecarExecutor) notifyDrain() {
 		return
 	}
 
-	// NB: Unfortunately, since exec.config.SidecarUrl points to
-	// `state.json`, we need to extract the Host from it first.
+	// NB: exec.config.SidecarUrl may still point to `state.json` in older
+	// configs, so we need to extract the Host from it first.
 	sidecarUrl, err := url.Parse(exec.config.SidecarUrl)
 	if err != nil {
 		log.Errorf("Error parsing Sidercar URL: %s", err)
@@ -164,11 +230,13 @@ func (exec *sidecarExecutor) notifyDrain() {
 		return
 	}
 
+	serviceId := sidecarServiceId(exec.sidecarContainerId(exec.containerID), exec.config.SidecarIdLength)
+
 	// URL.Host contains the port as well, if present
 	sidecarDrainServiceUrl := url.URL{
 		Scheme: sidecarUrl.Scheme,
 		Host:   sidecarUrl.Host,
-		Path:   fmt.Sprintf("/api/services/%s/drain", exec.containerID[:12]),
+		Path:   fmt.Sprintf("/api/services/%s/drain", serviceId),
 	}
 
 	drainer := func() (int, error) {
@@ -182,7 +250,7 @@ func (exec *sidecarExecutor) notifyDrain() {
 		return resp.StatusCode, nil
 	}
 
-	log.Warnf("Setting service ID %q status to DRAINING in Sidecar", exec.containerID[:12])
+	log.Warnf("Setting service ID %q status to DRAINING in Sidecar", serviceId)
 
 	// Bridge the watcher waitgroup to a channel
 	watcherDoneChan := make(chan struct{})
@@ -200,7 +268,10 @@ RETRIES:
 			break
 		}
 
-		log.Warnf("Failed %d attempts to set service to DRAINING in Sidecar!", i+1)
+		if err == nil {
+			err = fmt.Errorf("Sidecar returned status %d", status)
+		}
+		loghooks.LogRetry("sidecar-drain", i+1, exec.config.SidecarRetryCount+1, exec.config.SidecarRetryDelay, err)
 
 		select {
 		case <-watcherDoneChan:
@@ -233,3 +304,113 @@ func shouldCheckSidecar(containerConfig *docker.CreateContainerOptions) bool {
 
 	return true
 }
+
+// mesosLabelsForTask returns the labels on the Mesos task, as opposed to the
+// Docker labels on the container
+func mesosLabelsForTask(taskInfo *mesos.TaskInfo) map[string]string {
+	labels := make(map[string]string)
+	if taskInfo.Labels == nil {
+		return labels
+	}
+
+	for _, label := range taskInfo.Labels.Labels {
+		labels[label.Key] = label.GetValue()
+	}
+
+	return labels
+}
+
+// imageAllowed reports whether the image matches one of the glob patterns in
+// the allowlist. As with paths, a `*` doesn't match across a `/`. An empty
+// allowlist allows any image.
+func imageAllowed(image string, allowlist []string) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+
+	for _, pattern := range allowlist {
+		matched, err := path.Match(pattern, image)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runningDelayForTask returns how long to wait after starting the container
+// before sending TASK_RUNNING. Defaults to not waiting at all.
+func runningDelayForTask(labels map[string]string) time.Duration {
+	return durationLabel(labels, "executor.RunningDelay")
+}
+
+// maxRuntimeForTask returns how long the task may run before we kill it.
+// Defaults to no limit.
+func maxRuntimeForTask(labels map[string]string) time.Duration {
+	return durationLabel(labels, "MaxRuntime")
+}
+
+// criticalTask returns whether the task is marked critical with the Critical
+// label, in which case we don't assume it's healthy when Sidecar is
+// unavailable.
+func criticalTask(labels map[string]string) bool {
+	critical, _ := strconv.ParseBool(labels["Critical"])
+	return critical
+}
+
+// noLogRelay returns whether the task asked us not to relay its logs with
+// the NoLogRelay label, because it ships them itself.
+func noLogRelay(labels map[string]string) bool {
+	noRelay, _ := strconv.ParseBool(labels["NoLogRelay"])
+	return noRelay
+}
+
+// durationLabel parses a duration from the named label. Returns zero if the
+// label is missing or invalid.
+func durationLabel(labels map[string]string, name string) time.Duration {
+	value, ok := labels[name]
+	if !ok {
+		return 0
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Warnf("Invalid %s '%s', ignoring it", name, value)
+		return 0
+	}
+
+	return duration
+}
+
+// readinessAddrForTask returns the address to probe to confirm the container
+// is accepting connections before we send TASK_RUNNING. The label holds the
+// container port, which we map to the host port if there is a mapping for it.
+// Mapped ports are only published on the hostIP when there is one, so that's
+// where we probe them. Returns an empty string if no probe was requested.
+func readinessAddrForTask(taskInfo *mesos.TaskInfo, labels map[string]string, hostIP string) string {
+	value, ok := labels["executor.ReadinessPort"]
+	if !ok {
+		return ""
+	}
+
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 {
+		log.Warnf("Invalid executor.ReadinessPort '%s', not probing readiness", value)
+		return ""
+	}
+
+	host := "127.0.0.1"
+	if taskInfo.Container != nil && taskInfo.Container.Docker != nil {
+		for _, mapping := range taskInfo.Container.Docker.PortMappings {
+			if int(mapping.ContainerPort) == port && mapping.HostPort > 0 {
+				port = int(mapping.HostPort)
+				if ip := net.ParseIP(hostIP); ip != nil && !ip.IsUnspecified() {
+					host = hostIP
+				}
+				break
+			}
+		}
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Nitro/sidecar-executor/container"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How long we'll wait on Docker for stats when serving a health request
+	HealthStatsTimeout = 2 * time.Second
+)
+
+// healthResponse is the JSON we serve from the /health endpoint
+type healthResponse struct {
+	ContainerID   string
+	SidecarStatus string
+	Draining      bool
+	Uptime        string
+	TimeToHealthy string                    `json:",omitempty"`
+	Stats         *container.ContainerStats `json:",omitempty"`
+	StatsError    string                    `json:",omitempty"`
+}
+
+// healthState is what the /health endpoint reports about the task. The
+// goroutines watching the task publish it here as it changes, so that the
+// HTTP server never reads the executor's own fields while they're written.
+type healthState struct {
+	lock          sync.Mutex
+	containerID   string
+	sidecarStatus string
+	draining      bool
+	startedAt     time.Time
+	healthyAt     time.Time
+}
+
+// update changes the state while holding the lock
+func (s *healthState) update(fn func(*healthState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fn(s)
+}
+
+// sidecarStateResponse is the JSON we serve from the /debug/sidecar endpoint
+type sidecarStateResponse struct {
+	FetchedAt  string           `json:",omitempty"`
+	Body       string           `json:",omitempty"`
+	Parsed     *SidecarServices `json:",omitempty"`
+	ParseError string           `json:",omitempty"`
+}
+
+// serveHealth runs the HTTP server for the /health and /debug/sidecar
+// endpoints. It only returns if the server fails.
+func (exec *sidecarExecutor) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", exec.healthHandler)
+	mux.HandleFunc("/debug/sidecar", exec.sidecarStateHandler)
+
+	log.Infof("Serving executor health on %s", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Errorf("Health endpoint failed: %s", err)
+	}
+}
+
+// healthHandler reports on the task, including a live sample of the
+// container's resource usage from Docker.
+func (exec *sidecarExecutor) healthHandler(w http.ResponseWriter, r *http.Request) {
+	state := &exec.health
+	state.lock.Lock()
+	response := healthResponse{
+		ContainerID:   state.containerID,
+		SidecarStatus: state.sidecarStatus,
+		Draining:      state.draining,
+	}
+	startedAt, healthyAt := state.startedAt, state.healthyAt
+	state.lock.Unlock()
+
+	if !startedAt.IsZero() {
+		response.Uptime = time.Since(startedAt).Round(time.Second).String()
+	}
+
+	if !healthyAt.IsZero() {
+		response.TimeToHealthy = healthyAt.Sub(startedAt).Round(time.Second).String()
+	}
+
+	if response.ContainerID != "" {
+		stats, err := container.SampleStats(exec.client, response.ContainerID, HealthStatsTimeout)
+		if err != nil {
+			log.Warn(err.Error())
+			response.StatsError = err.Error()
+		}
+		response.Stats = stats
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Errorf("Unable to write health response: %s", err)
+	}
+}
+
+// sidecarStateHandler returns the last state we fetched from Sidecar, as we
+// got it, along with what we parsed from it. That shows why we decided what we
+// did about the service, e.g. when we assumed it was healthy. It's empty until
+// the first fetch.
+func (exec *sidecarExecutor) sidecarStateHandler(w http.ResponseWriter, r *http.Request) {
+	cache := &exec.sidecarState
+	cache.lock.Lock()
+	response := sidecarStateResponse{
+		Body:       string(cache.body),
+		Parsed:     cache.services,
+		ParseError: cache.parseError,
+	}
+	if !cache.fetchedAt.IsZero() {
+		response.FetchedAt = cache.fetchedAt.Format(time.RFC3339)
+	}
+	cache.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Errorf("Unable to write Sidecar state response: %s", err)
+	}
+}
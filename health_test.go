@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar-executor/container"
+	docker "github.com/fsouza/go-dockerclient"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_healthHandler(t *testing.T) {
+	Convey("When serving the health endpoint", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		client := &container.MockDockerClient{}
+		exec := newSidecarExecutor(client, &docker.AuthConfiguration{}, Config{})
+		exec.health.update(func(s *healthState) {
+			s.containerID = "deadbeef0010"
+			s.sidecarStatus = "Healthy"
+			s.startedAt = time.Now().Add(-time.Minute)
+		})
+
+		getHealth := func() healthResponse {
+			recorder := httptest.NewRecorder()
+			exec.healthHandler(recorder, httptest.NewRequest("GET", "/health", nil))
+
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			var response healthResponse
+			So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+			return response
+		}
+
+		Convey("includes the container's resource usage", func() {
+			stats := &docker.Stats{}
+			stats.CPUStats.CPUUsage.TotalUsage = 300
+			stats.CPUStats.CPUUsage.PercpuUsage = []uint64{150, 150}
+			stats.CPUStats.SystemCPUUsage = 2000
+			stats.PreCPUStats.CPUUsage.TotalUsage = 100
+			stats.PreCPUStats.SystemCPUUsage = 1000
+			stats.MemoryStats.Usage = 64 * 1024 * 1024
+			stats.MemoryStats.Limit = 128 * 1024 * 1024
+			client.StatsSample = stats
+
+			response := getHealth()
+
+			So(response.ContainerID, ShouldEqual, "deadbeef0010")
+			So(response.SidecarStatus, ShouldEqual, "Healthy")
+			So(response.Uptime, ShouldEqual, "1m0s")
+			So(response.TimeToHealthy, ShouldBeEmpty)
+			So(response.StatsError, ShouldBeEmpty)
+			So(response.Stats, ShouldNotBeNil)
+			So(response.Stats.CPUPercent, ShouldEqual, 40) // 200/1000 across 2 CPUs
+			So(response.Stats.MemoryUsage, ShouldEqual, 64*1024*1024)
+			So(response.Stats.MemoryLimit, ShouldEqual, 128*1024*1024)
+		})
+
+		Convey("includes how long the service took to become healthy", func() {
+			exec.health.update(func(s *healthState) { s.healthyAt = s.startedAt.Add(20 * time.Second) })
+
+			response := getHealth()
+
+			So(response.TimeToHealthy, ShouldEqual, "20s")
+		})
+
+		Convey("picks up what the watcher publishes while serving", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 100; i++ {
+					exec.health.update(func(s *healthState) { s.draining = i%2 == 0 })
+				}
+				exec.health.update(func(s *healthState) { s.draining = true })
+			}()
+
+			for i := 0; i < 10; i++ {
+				getHealth()
+			}
+			<-done
+
+			So(getHealth().Draining, ShouldBeTrue)
+		})
+
+		Convey("reports when Docker can't provide stats", func() {
+			client.StatsShouldError = true
+
+			response := getHealth()
+
+			So(response.Stats, ShouldBeNil)
+			So(response.StatsError, ShouldContainSubstring, "[Stats()]")
+		})
+
+		Convey("doesn't hang on a slow daemon", func() {
+			client.StatsSample = &docker.Stats{}
+			client.StatsDelay = 3 * HealthStatsTimeout
+
+			start := time.Now()
+			response := getHealth()
+
+			So(time.Since(start), ShouldBeLessThan, 2*HealthStatsTimeout)
+			So(response.StatsError, ShouldContainSubstring, "Timed out")
+		})
+	})
+}
+
+func Test_sidecarStateHandler(t *testing.T) {
+	Convey("When serving the Sidecar state debug endpoint", t, func() {
+		log.SetOutput(ioutil.Discard)
+		os.Setenv("TASK_HOST", "roncevalles")
+
+		fetcher := &mockFetcher{}
+		exec := newSidecarExecutor(&container.MockDockerClient{}, &docker.AuthConfiguration{}, Config{})
+		exec.fetcher = fetcher
+
+		getState := func() sidecarStateResponse {
+			recorder := httptest.NewRecorder()
+			exec.sidecarStateHandler(recorder, httptest.NewRequest("GET", "/debug/sidecar", nil))
+
+			So(recorder.Code, ShouldEqual, 200)
+			So(recorder.Header().Get("Content-Type"), ShouldEqual, "application/json")
+
+			var response sidecarStateResponse
+			So(json.Unmarshal(recorder.Body.Bytes(), &response), ShouldBeNil)
+			return response
+		}
+
+		Convey("is empty before the first check", func() {
+			response := getState()
+
+			So(response.FetchedAt, ShouldBeEmpty)
+			So(response.Body, ShouldBeEmpty)
+			So(response.Parsed, ShouldBeNil)
+		})
+
+		Convey("returns the body from the last check, and what we parsed", func() {
+			So(exec.sidecarStatus("deadbeef0010"), ShouldBeNil)
+
+			response := getState()
+
+			So(response.FetchedAt, ShouldNotBeEmpty)
+			So(response.Body, ShouldContainSubstring, `"roncevalles"`)
+			So(response.Parsed, ShouldNotBeNil)
+			So(response.Parsed.Servers, ShouldContainKey, "roncevalles")
+			So(response.ParseError, ShouldBeEmpty)
+		})
+
+		Convey("returns the body that didn't parse, and why", func() {
+			fetcher.ShouldBadJson = true
+			So(exec.sidecarStatus("deadbeef0010"), ShouldBeNil)
+
+			response := getState()
+
+			So(response.Body, ShouldNotBeEmpty)
+			So(response.Parsed, ShouldBeNil)
+			So(response.ParseError, ShouldNotBeEmpty)
+		})
+	})
+}
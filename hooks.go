@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	osexec "os/exec"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// runPostStopHook runs the PostStopCommand, if there is one, once the task
+// has ended. This is for cleanup like flushing metrics or deregistering from
+// external systems. The command gets the task ID, container ID, and final
+// state in its env, and its output goes to the Mesos sandbox logs. It's killed
+// if it takes longer than PostStopTimeout. Failures are logged, but don't
+// change how the task ended. It only runs if the container ran and has
+// stopped, so not for tasks that never launched, or containers we were only
+// watching.
+func (exec *sidecarExecutor) runPostStopHook(status int64, taskInfo *mesos.TaskInfo) {
+	if exec.config.PostStopCommand == "" {
+		return
+	}
+
+	if !exec.containerExited {
+		log.Info("No container was stopped, skipping the post-stop command")
+		return
+	}
+
+	ctx := context.Background()
+	if exec.config.PostStopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, exec.config.PostStopTimeout)
+		defer cancel()
+	}
+
+	cmd := osexec.CommandContext(ctx, "/bin/sh", "-c", exec.config.PostStopCommand)
+	cmd.Env = append(os.Environ(),
+		"TASK_ID="+taskInfo.TaskID.Value,
+		"CONTAINER_ID="+exec.containerID,
+		"TASK_STATE="+taskState(status).String(),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.Infof("Running post-stop command: %s", exec.config.PostStopCommand)
+	started := time.Now()
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		log.Errorf("Post-stop command timed out after %s", exec.config.PostStopTimeout)
+		return
+	}
+
+	if err != nil {
+		log.Errorf("Post-stop command failed: %s", err)
+		return
+	}
+
+	log.Infof("Post-stop command finished in %s", time.Since(started).Round(time.Millisecond))
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Nitro/sidecar-executor/container"
+	docker "github.com/fsouza/go-dockerclient"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_runPostStopHook(t *testing.T) {
+	Convey("The post-stop hook", t, func() {
+		var captured bytes.Buffer
+		log.SetOutput(&captured)
+
+		dir, err := ioutil.TempDir("", "post-stop")
+		So(err, ShouldBeNil)
+		Reset(func() { os.RemoveAll(dir) })
+		outFile := filepath.Join(dir, "out")
+
+		exec := newSidecarExecutor(&container.MockDockerClient{}, &docker.AuthConfiguration{}, Config{})
+		exec.driver = &mockDriver{}
+		exec.statusSleepTime = 0
+		exec.config.PostStopTimeout = time.Second
+
+		taskInfo := &mesos.TaskInfo{TaskID: mesos.TaskID{Value: "beowulf-1"}}
+
+		Convey("runs when the task finishes", func() {
+			exec.config.PostStopCommand = "echo $TASK_ID $TASK_STATE > " + outFile
+			exec.handleContainerExit("deadbeef0010", taskInfo, 0, nil)
+
+			out, err := ioutil.ReadFile(outFile)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, "beowulf-1 TASK_FINISHED\n")
+		})
+
+		Convey("runs when the task fails", func() {
+			exec.config.PostStopCommand = "echo $TASK_STATE > " + outFile
+			exec.handleContainerExit("deadbeef0010", taskInfo, 1, nil)
+
+			out, err := ioutil.ReadFile(outFile)
+			So(err, ShouldBeNil)
+			So(string(out), ShouldEqual, "TASK_FAILED\n")
+		})
+
+		Convey("doesn't run when the task never launched", func() {
+			exec.config.PostStopCommand = "echo $TASK_STATE > " + outFile
+			exec.errorTask(taskInfo, "Invalid task data")
+
+			_, err := os.Stat(outFile)
+			So(os.IsNotExist(err), ShouldBeTrue)
+			So(captured.String(), ShouldContainSubstring, "skipping the post-stop command")
+		})
+
+		Convey("is killed when it runs too long", func() {
+			exec.config.PostStopCommand = "sleep 10"
+			exec.config.PostStopTimeout = 20 * time.Millisecond
+
+			started := time.Now()
+			exec.handleContainerExit("deadbeef0010", taskInfo, 0, nil)
+
+			So(time.Since(started), ShouldBeLessThan, 5*time.Second)
+			So(captured.String(), ShouldContainSubstring, "Post-stop command timed out")
+		})
+
+		Convey("logs failures", func() {
+			exec.config.PostStopCommand = "exit 3"
+			exec.handleContainerExit("deadbeef0010", taskInfo, 0, nil)
+
+			So(captured.String(), ShouldContainSubstring, "Post-stop command failed")
+		})
+	})
+}
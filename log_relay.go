@@ -2,8 +2,12 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Nitro/sidecar-executor/container"
@@ -11,27 +15,59 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// How often to log about lines dropped by a backed up relay
+	RelayDropLogEvery = 1000
+
+	// The structured data element for the Mesos task labels, when relaying
+	// RFC 5424 syslog
+	MesosLabelsSDID = "mesos@32473"
+)
+
+var errPumpStopped = errors.New("Log pump stopped")
+
 func (exec *sidecarExecutor) configureLogRelay(containerId string,
 	labels map[string]string, output io.Writer) *log.Entry {
 
 	syslogger := log.New()
 	// We relay UDP syslog because we don't plan to ship it off the box
 	// and because it's simplest since there is no backpressure issue to
-	// deal with.
-	hook, err := loghooks.NewUDPHook(exec.config.SyslogAddr)
-	if err != nil {
-		log.Fatalf("Error adding hook: %s", err)
-	}
-
-	syslogger.Hooks.Add(hook)
-	syslogger.SetFormatter(&log.JSONFormatter{
-		FieldMap: log.FieldMap{
-			log.FieldKeyTime:  "Timestamp",
-			log.FieldKeyLevel: "Level",
-			log.FieldKeyMsg:   "Payload",
-			log.FieldKeyFunc:  "Func",
-		},
-	})
+	// deal with. There may be more than one destination, in which case
+	// each log line is sent to all of them.
+	for _, addr := range strings.Split(exec.config.SyslogAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		hook, err := exec.newSyslogHook(addr)
+		if err != nil {
+			log.Errorf("Error adding hook for '%s': %s", addr, err)
+			continue
+		}
+
+		syslogger.Hooks.Add(hook)
+	}
+
+	if exec.config.SyslogFormat == "rfc5424" {
+		// Collectors that speak syslog can also have the Mesos task labels
+		syslogger.SetFormatter(&loghooks.RFC5424Formatter{
+			Hostname: exec.config.LogHostname,
+			AppName:  labels["ServiceName"],
+			StructuredData: map[string]map[string]string{
+				MesosLabelsSDID: exec.taskLabels,
+			},
+		})
+	} else {
+		syslogger.SetFormatter(&log.JSONFormatter{
+			FieldMap: log.FieldMap{
+				log.FieldKeyTime:  "Timestamp",
+				log.FieldKeyLevel: "Level",
+				log.FieldKeyMsg:   "Payload",
+				log.FieldKeyFunc:  "Func",
+			},
+		})
+	}
 	syslogger.SetOutput(output)
 
 	// Add one to the labels length to account for hostname
@@ -44,57 +80,250 @@ func (exec *sidecarExecutor) configureLogRelay(containerId string,
 			fields[field] = val
 		}
 	}
+
+	// Tasks can also add their own fields with LogField.<name> labels
+	for key, val := range labels {
+		if name := strings.TrimPrefix(key, "LogField."); name != key && name != "" {
+			fields[name] = val
+		}
+	}
+
 	fields["Hostname"] = exec.config.LogHostname
 
 	return syslogger.WithFields(fields)
 }
 
-// relayLogs will watch a container and send the logs to Syslog
-func (exec *sidecarExecutor) relayLogs(quitChan chan struct{},
+// newSyslogHook returns the hook for one syslog destination. Addresses are UDP
+// unless prefixed with "tcp://". TCP streams may be gzipped, but only if the
+// collector expects it, and are reconnected if the collector goes away.
+func (exec *sidecarExecutor) newSyslogHook(addr string) (log.Hook, error) {
+	if strings.HasPrefix(addr, "tcp://") {
+		if exec.config.SyslogCompress {
+			log.Infof("Sending gzip compressed logs to %s", addr)
+		}
+		hook, err := loghooks.NewTCPHook(strings.TrimPrefix(addr, "tcp://"), exec.config.SyslogCompress)
+		if err != nil {
+			return nil, err
+		}
+		hook.ReconnectDelay = exec.config.SyslogReconnectDelay
+		hook.BufferLines = exec.config.SyslogBufferLines
+		hook.AddPriority = exec.addSyslogPriority()
+		return hook, nil
+	}
+
+	if exec.config.SyslogCompress {
+		log.Warnf("SyslogCompress is only supported over TCP, sending uncompressed logs to %s", addr)
+	}
+	hook, err := loghooks.NewUDPHook(strings.TrimPrefix(addr, "udp://"))
+	if err != nil {
+		return nil, err
+	}
+	hook.AddPriority = exec.addSyslogPriority()
+	return hook, nil
+}
+
+// addSyslogPriority reports whether the hooks have to send the syslog priority
+// of each line themselves. The RFC5424Formatter already writes it.
+func (exec *sidecarExecutor) addSyslogPriority() bool {
+	return exec.config.SyslogFormat != "rfc5424"
+}
+
+// relayLogs will watch a container and send the logs to Syslog, until the
+// context is cancelled
+func (exec *sidecarExecutor) relayLogs(ctx context.Context,
 	containerId string, labels map[string]string, output io.Writer) {
 
+	// This is used for apps that do their own logging when started, but
+	// might fail during startup and need us to pump startup logs.
+	if exec.config.RelaySyslogStartupOnly {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, exec.config.RelaySyslogStartupTime)
+		defer cancel()
+	}
+
+	// Skip the noise the service makes starting up, and only relay what it
+	// logs once Sidecar first reports it as healthy. That happens in the
+	// watcher, which closes the channel.
+	whenHealthy := exec.config.RelaySyslogWhenHealthy && shouldCheckSidecar(exec.containerConfig)
+	if whenHealthy {
+		log.Info("Waiting for the service to be healthy before relaying logs")
+		select {
+		case <-exec.healthyChan:
+		case <-ctx.Done():
+			return
+		}
+	}
+
 	logger := exec.configureLogRelay(containerId, labels, output)
 
 	logger.Infof("sidecar-executor starting log pump for '%s'", containerId[:12])
 	log.Info("Started syslog log pump") // Send to local log output
 
-	outrd, outwr := io.Pipe()
-	errrd, errwr := io.Pipe()
-
 	// Tell Docker client to start pumping logs into our pipes
-	container.FollowLogs(exec.client, containerId, 0, outwr, errwr)
+	since, tail := exec.relayReplayWindow()
+	if whenHealthy {
+		// Replaying would send the startup logs we just waited out
+		since, tail = 0, "0"
+	}
 
-	go exec.handleOneStream(quitChan, "stdout", logger, outrd)
-	go exec.handleOneStream(quitChan, "stderr", logger, errrd)
+	// If following the logs fails, we follow them again from where we got
+	// to, so that the relay doesn't stop for good while the container runs
+	for restarts := 0; ; restarts++ {
+		err := exec.followLogs(ctx, containerId, logger, since, tail)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
 
-	if exec.config.RelaySyslogStartupOnly {
-		go cancelAfterStartup(quitChan, exec.config.RelaySyslogStartupTime)
+		if restarts >= exec.config.RelayRestartCount {
+			log.Errorf("Log pump failed, giving up after %d restarts: %s", restarts, err)
+			break
+		}
+
+		log.Warnf("Log pump failed, restarting in %s: %s", exec.config.RelayRestartDelay, err)
+		since, tail = time.Now().Unix(), "all"
+
+		select {
+		case <-time.After(exec.config.RelayRestartDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	<-ctx.Done()
+}
+
+// followLogs follows the container's logs once, pumping the streams into the
+// logger. It returns when Docker is done sending logs and the pumps have
+// caught up, or with the first error from Docker or either pump. Cancelling
+// the context also returns, without an error.
+func (exec *sidecarExecutor) followLogs(ctx context.Context, containerId string,
+	logger *log.Entry, since int64, tail string) error {
+
+	// One result from each pump, and one from Docker
+	results := make(chan error, 3)
+	var pipes []*io.PipeWriter
+
+	pump := func(name string) io.Writer {
+		rd, wr := io.Pipe()
+		pipes = append(pipes, wr)
+
+		go func() {
+			err := exec.handleOneStream(ctx, containerId, name, logger, rd)
+			// Don't leave Docker blocked writing to a pipe no one reads
+			rd.CloseWithError(errPumpStopped)
+			results <- err
+		}()
+
+		return wr
+	}
+
+	// We only pump the streams we were asked for. Docker isn't asked for the
+	// others, so there's nothing to read from them.
+	var outwr, errwr io.Writer
+	if exec.config.RelaySyslogStreams != "stderr" {
+		outwr = pump("stdout")
+	}
+
+	if exec.config.RelaySyslogStreams != "stdout" {
+		errwr = pump("stderr")
+	}
+
+	go func() {
+		err := container.FollowLogs(exec.client, containerId, since, tail, outwr, errwr)
+		for _, pipe := range pipes {
+			pipe.CloseWithError(err) // A nil error is a clean EOF
+		}
+		results <- err
+	}()
+
+	for i := 0; i < len(pipes)+1; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
 	}
 
-	<-quitChan
+	return nil
 }
 
-// cancelAfterStartup will stop the log pump after RelaySyslogStartupTime. This
-// is used for apps that do their lown logging when started, but might fail
-// during startup and need us to pump startup logs.
-func cancelAfterStartup(quitChan chan struct{}, startupTime time.Duration) {
-	<-time.After(startupTime)
-	close(quitChan)
+// relayReplayWindow returns how much of the existing container logs to replay
+// when the relay starts, as a Unix time to start from and a number of lines.
+// When we took over a running container, it has its own window, so that the
+// logs from while the executor was gone aren't lost.
+func (exec *sidecarExecutor) relayReplayWindow() (int64, string) {
+	if !exec.attached {
+		return 0, exec.config.RelaySyslogTail
+	}
+
+	tail := exec.config.RelaySyslogTail
+	if exec.config.RelaySyslogAttachTail != "" {
+		tail = exec.config.RelaySyslogAttachTail
+	}
+
+	var since int64
+	if exec.config.RelaySyslogAttachSince > 0 {
+		since = time.Now().Add(-exec.config.RelaySyslogAttachSince).Unix()
+	}
+
+	return since, tail
 }
 
-// handleOneStream will process one data stream into logs
-func (exec *sidecarExecutor) handleOneStream(quitChan chan struct{}, name string,
-	logger *log.Entry, in io.Reader) {
+// handleOneStream will process one data stream into logs. It returns the
+// error that stopped it, or nil when the stream ended or we were cancelled.
+func (exec *sidecarExecutor) handleOneStream(ctx context.Context, containerId string,
+	name string, logger *log.Entry, in io.Reader) error {
 
 	scanner := bufio.NewScanner(in) // Defaults to splitting as lines
 
+	// Let downstream systems tell stdout and stderr apart
+	logger = logger.WithField("stream", name)
+
+	if name != "stdout" && name != "stderr" {
+		log.Errorf("handleOneStream(): Unknown stream type '%s'. Exiting log pump.", name)
+		return fmt.Errorf("Unknown stream type '%s'", name)
+	}
+
+	ship := func(text string) {
+		// Pretty basic attempt to scrape only errors from stderr
+		if name == "stderr" && strings.Contains(strings.ToLower(text), "error") {
+			logger.Error(text) // Send to syslog "error"
+		} else {
+			logger.Info(text) // Send to syslog "info"
+		}
+	}
+
+	// Unless the stream has a severity of its own
+	severity := exec.config.RelayStdoutSeverity
+	if name == "stderr" {
+		severity = exec.config.RelayStderrSeverity
+	}
+
+	if sev, ok := loghooks.ParseSeverity(severity); ok {
+		level := loghooks.SeverityLevel(sev)
+		severityLogger := logger.WithField(loghooks.SeverityField, severity)
+		ship = func(text string) {
+			severityLogger.Log(level, text)
+		}
+	}
+
+	// When limited, lines are shipped by their own goroutine so that a slow
+	// destination doesn't hold up reading from Docker.
+	if exec.config.RelayMaxInFlight > 0 {
+		shipper := exec.newLineShipper(name, ship)
+		defer shipper.Close()
+		ship = shipper.Send
+	}
+
 	for scanner.Scan() {
 		// Before processing anything, see if we should be exiting.  Note that
 		// this still doesn't exit until the _next_ log is processed after the
-		// channel was closed.
+		// context was cancelled.
 		select {
-		case <-quitChan:
-			return
+		case <-ctx.Done():
+			return nil
 		default:
 			// nothing
 		}
@@ -102,24 +331,99 @@ func (exec *sidecarExecutor) handleOneStream(quitChan chan struct{}, name string
 		text := scanner.Text()
 		log.Debugf("docker: %s", text)
 
-		switch name {
-		case "stdout":
-			logger.Info(text) // Send to syslog "info"
-		case "stderr":
-			// Pretty basic attempt to scrape only errors from the logs
-			if strings.Contains(strings.ToLower(text), "error") {
-				logger.Error(text) // Send to syslog "error"
-			} else {
-				logger.Info(text) // Send to syslog "info"
-			}
-		default:
-			log.Errorf("handleOneStream(): Unknown stream type '%s'. Exiting log pump.", name)
-			return
+		if exec.config.RelayLogsStdout {
+			exec.writeRelayStdout(containerId, name, text)
 		}
+
+		ship(text)
 	}
 	if err := scanner.Err(); err != nil {
 		log.Errorf("handleOneStream() error reading Docker log input: '%s'. Exiting log pump '%s'.", err, name)
+		return err
 	}
 
 	log.Warnf("Log pump exited for '%s'", name)
+	return nil
+}
+
+// writeRelayStdout writes one line of container output to our stdout, prefixed
+// with the short container ID and the stream it came from.
+func (exec *sidecarExecutor) writeRelayStdout(containerId string, name string, text string) {
+	shortId := containerId
+	if len(shortId) > 12 {
+		shortId = shortId[:12]
+	}
+
+	exec.relayStdoutLock.Lock()
+	defer exec.relayStdoutLock.Unlock()
+
+	fmt.Fprintf(exec.relayStdout, "[%s %s] %s\n", shortId, name, text)
+}
+
+// lineShipper ships the lines from one stream, in order, from a separate
+// goroutine. It bounds how many lines have been read but not yet shipped to
+// RelayMaxInFlight, to limit memory use during bursts. When that many are in
+// flight, new lines either wait for a slot, or are dropped, depending on the
+// RelayOverflowPolicy.
+type lineShipper struct {
+	name    string
+	ship    func(string)
+	lines   chan string
+	slots   chan struct{}
+	done    chan struct{}
+	drop    bool
+	dropped int
+	// Shared by all streams, for visibility into the relay
+	inFlight *int64
+}
+
+func (exec *sidecarExecutor) newLineShipper(name string, ship func(string)) *lineShipper {
+	shipper := &lineShipper{
+		name:     name,
+		ship:     ship,
+		lines:    make(chan string, exec.config.RelayMaxInFlight),
+		slots:    make(chan struct{}, exec.config.RelayMaxInFlight),
+		done:     make(chan struct{}),
+		drop:     exec.config.RelayOverflowPolicy == "drop",
+		inFlight: &exec.relayInFlight,
+	}
+
+	go shipper.run()
+
+	return shipper
+}
+
+// Send queues a line to ship, once there is a slot for it
+func (s *lineShipper) Send(text string) {
+	select {
+	case s.slots <- struct{}{}:
+	default:
+		if s.drop {
+			if s.dropped%RelayDropLogEvery == 0 {
+				log.Warnf("Relay for '%s' is backed up, dropped %d lines", s.name, s.dropped+1)
+			}
+			s.dropped += 1
+			return
+		}
+		s.slots <- struct{}{}
+	}
+
+	atomic.AddInt64(s.inFlight, 1)
+	s.lines <- text
+}
+
+// Close ships anything still queued, then returns
+func (s *lineShipper) Close() {
+	close(s.lines)
+	<-s.done
+}
+
+func (s *lineShipper) run() {
+	defer close(s.done)
+
+	for text := range s.lines {
+		s.ship(text)
+		atomic.AddInt64(s.inFlight, -1)
+		<-s.slots
+	}
 }
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -15,6 +21,51 @@ import (
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// readPackets reads everything sent to a UDP listener until it goes quiet
+func readPackets(conn net.PacketConn) string {
+	var received strings.Builder
+	buf := make([]byte, 65536)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received.Write(buf[:n])
+	}
+
+	return received.String()
+}
+
+// slowHook stands in for a slow syslog destination. It records the most lines
+// the relay had in flight while it was shipping one.
+type slowHook struct {
+	exec        *sidecarExecutor
+	delay       time.Duration
+	release     chan struct{}
+	fired       int
+	maxInFlight int64
+}
+
+func (h *slowHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *slowHook) Fire(entry *log.Entry) error {
+	if inFlight := atomic.LoadInt64(&h.exec.relayInFlight); inFlight > h.maxInFlight {
+		h.maxInFlight = inFlight
+	}
+
+	if h.release != nil {
+		<-h.release
+	}
+	time.Sleep(h.delay)
+
+	h.fired += 1
+	return nil
+}
+
 func Test_relayLogs(t *testing.T) {
 	// This test can't run on Travis due to some issue with sending UDP
 	if os.Getenv("TRAVIS") != "true" {
@@ -36,7 +87,8 @@ func Test_relayLogs(t *testing.T) {
 			fetcher := &mockFetcher{}
 			exec.fetcher = fetcher
 
-			quitChan := make(chan struct{})
+			ctx, cancel := context.WithCancel(context.Background())
+			Reset(cancel)
 			tmpdir, _ := ioutil.TempDir("", "testing")
 			tmpfn := filepath.Join(tmpdir, "log-relay")
 
@@ -48,9 +100,9 @@ func Test_relayLogs(t *testing.T) {
 
 				// Janky that we have to sleep here, but not a good way to
 				// sync on this.
-				go func() { time.Sleep(20 * time.Millisecond); close(quitChan) }()
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
 
-				exec.relayLogs(quitChan, "deadbeef123123123", map[string]string{}, result)
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
 
 				resultBytes, _ := ioutil.ReadFile(tmpfn)
 				So(string(resultBytes), ShouldContainSubstring, "some stdout text")
@@ -58,19 +110,145 @@ func Test_relayLogs(t *testing.T) {
 				result.Close()
 			})
 
+			Convey("passes the configured tail to Docker", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				exec.config.RelaySyslogTail = "0"
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(dockerClient.LastLogsOptions(), ShouldNotBeNil)
+				So(dockerClient.LastLogsOptions().Tail, ShouldEqual, "0")
+				So(dockerClient.LastLogsOptions().Follow, ShouldBeTrue)
+				result.Close()
+			})
+
+			Convey("replays the attach window when we took over the container", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				exec.config.RelaySyslogTail = "0"
+				exec.config.RelaySyslogAttachTail = "500"
+				exec.config.RelaySyslogAttachSince = 5 * time.Minute
+				exec.attached = true
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				opts := dockerClient.LastLogsOptions()
+				So(opts.Tail, ShouldEqual, "500")
+				So(opts.Since, ShouldBeBetweenOrEqual,
+					time.Now().Add(-5*time.Minute-time.Second).Unix(),
+					time.Now().Add(-5*time.Minute).Unix(),
+				)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, "some stdout text")
+				result.Close()
+			})
+
+			Convey("uses the normal tail when it launched the container", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				exec.config.RelaySyslogTail = "0"
+				exec.config.RelaySyslogAttachTail = "500"
+				exec.config.RelaySyslogAttachSince = 5 * time.Minute
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(dockerClient.LastLogsOptions().Tail, ShouldEqual, "0")
+				So(dockerClient.LastLogsOptions().Since, ShouldEqual, 0)
+				result.Close()
+			})
+
+			Convey("relays nothing until the service is healthy, when asked", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				exec.config.RelaySyslogWhenHealthy = true
+				exec.containerConfig = &docker.CreateContainerOptions{
+					Config: &docker.Config{Labels: map[string]string{}},
+				}
+				exec.startedAt = time.Now()
+
+				var beforeHealthy []byte
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					beforeHealthy, _ = ioutil.ReadFile(tmpfn)
+					exec.recordHealthy()
+					time.Sleep(20 * time.Millisecond)
+					cancel()
+				}()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(string(beforeHealthy), ShouldBeEmpty)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, "some stdout text")
+				So(dockerClient.LastLogsOptions().Tail, ShouldEqual, "0")
+				result.Close()
+			})
+
+			Convey("follows the logs again when following them fails", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				dockerClient.LogsFailures = 1
+				exec.config.RelayRestartDelay = time.Millisecond
+
+				go func() { time.Sleep(50 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(dockerClient.LogsCalls, ShouldEqual, 2)
+				So(dockerClient.LastLogsOptions().Since, ShouldBeGreaterThan, 0)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, "some stdout text")
+				result.Close()
+			})
+
+			Convey("gives up following the logs after too many failures", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				dockerClient.LogsFailures = 10
+				exec.config.RelayRestartCount = 2
+				exec.config.RelayRestartDelay = time.Millisecond
+
+				go func() { time.Sleep(50 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(dockerClient.LogsCalls, ShouldEqual, 3)
+				result.Close()
+			})
+
+			Convey("relays only the selected stream", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+				exec.config.RelaySyslogStreams = "stderr"
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, "some stderr text")
+				So(string(resultBytes), ShouldNotContainSubstring, "some stdout text")
+				So(dockerClient.LastLogsOptions().Stdout, ShouldBeFalse)
+				So(dockerClient.LastLogsOptions().Stderr, ShouldBeTrue)
+				result.Close()
+			})
+
 			Convey("includes the requested Docker labels", func() {
 				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
 
 				// Janky that we have to sleep here, but not a good way to
 				// sync on this.
-				go func() { time.Sleep(1 * time.Millisecond); close(quitChan) }()
+				go func() { time.Sleep(1 * time.Millisecond); cancel() }()
 
 				labels := map[string]string{
 					"Environment": "prod",
 					"ServiceName": "beowulf",
 				}
 
-				exec.relayLogs(quitChan, "deadbeef123123123", labels, result)
+				exec.relayLogs(ctx, "deadbeef123123123", labels, result)
 				exec.config.ContainerLogsStdout = true
 
 				resultBytes, _ := ioutil.ReadFile(tmpfn)
@@ -79,19 +257,57 @@ func Test_relayLogs(t *testing.T) {
 				result.Close()
 			})
 
+			Convey("includes fields from LogField labels", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				go func() { time.Sleep(1 * time.Millisecond); cancel() }()
+
+				labels := map[string]string{
+					"LogField.Team":      "geats",
+					"LogField.Component": "mead-hall",
+					"LogField.Hostname":  "heorot",
+				}
+
+				exec.config.LogHostname = "beowulf.local"
+				exec.relayLogs(ctx, "deadbeef123123123", labels, result)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, `"Team":"geats"`)
+				So(string(resultBytes), ShouldContainSubstring, `"Component":"mead-hall"`)
+				So(string(resultBytes), ShouldContainSubstring, `"Hostname":"beowulf.local"`)
+				So(string(resultBytes), ShouldNotContainSubstring, "LogField.")
+				result.Close()
+			})
+
+			Convey("sends the Mesos task labels as RFC 5424 structured data", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.config.SyslogFormat = "rfc5424"
+				exec.taskLabels = map[string]string{"Team": "geats"}
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{"ServiceName": "beowulf"}, result)
+
+				resultBytes, _ := ioutil.ReadFile(tmpfn)
+				So(string(resultBytes), ShouldContainSubstring, `[mesos@32473 Team="geats"]`)
+				So(string(resultBytes), ShouldContainSubstring, " beowulf - - [fields@32473 ")
+				So(string(resultBytes), ShouldContainSubstring, "] some stdout text")
+				result.Close()
+			})
+
 			Convey("sends the hostname", func() {
 				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
 
 				// Janky that we have to sleep here, but not a good way to
 				// sync on this.
-				go func() { time.Sleep(1 * time.Millisecond); close(quitChan) }()
+				go func() { time.Sleep(1 * time.Millisecond); cancel() }()
 
 				labels := map[string]string{
 					"Environment": "prod",
 					"ServiceName": "beowulf",
 				}
 
-				exec.relayLogs(quitChan, "deadbeef123123123", labels, result)
+				exec.relayLogs(ctx, "deadbeef123123123", labels, result)
 				exec.config.ContainerLogsStdout = true
 
 				resultBytes, _ := ioutil.ReadFile(tmpfn)
@@ -99,26 +315,130 @@ func Test_relayLogs(t *testing.T) {
 				So(string(resultBytes), ShouldContainSubstring, `"Hostname":"`+exec.config.LogHostname)
 			})
 
+			Convey("fans out to all the syslog destinations", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				first, err := net.ListenPacket("udp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer first.Close()
+
+				second, err := net.ListenPacket("udp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer second.Close()
+
+				exec.config.SyslogAddr = first.LocalAddr().String() + ", " + second.LocalAddr().String()
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(readPackets(first), ShouldContainSubstring, "some stdout text")
+				So(readPackets(second), ShouldContainSubstring, "some stdout text")
+				result.Close()
+			})
+
+			Convey("sends a gzip compressed stream over TCP when asked", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer listener.Close()
+
+				received := make(chan string, 1)
+				go func() {
+					conn, err := listener.Accept()
+					if err != nil {
+						received <- ""
+						return
+					}
+					defer conn.Close()
+
+					gz, err := gzip.NewReader(conn)
+					if err != nil {
+						received <- ""
+						return
+					}
+
+					line, _ := bufio.NewReader(gz).ReadString('\n')
+					received <- line
+				}()
+
+				exec.config.SyslogAddr = "tcp://" + listener.Addr().String()
+				exec.config.SyslogCompress = true
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				var line string
+				select {
+				case line = <-received:
+				case <-time.After(time.Second):
+				}
+				So(line, ShouldContainSubstring, "starting log pump")
+				result.Close()
+			})
+
+			Convey("starts each JSON line with its syslog priority", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer listener.Close()
+
+				exec.config.SyslogAddr = listener.LocalAddr().String()
+				exec.config.RelayStdoutSeverity = "notice"
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				// The user facility is 1, and notice is severity 5
+				received := readPackets(listener)
+				So(received, ShouldContainSubstring, "some stdout text")
+				So(received, ShouldContainSubstring, `<13>{"`)
+				So(received, ShouldNotStartWith, "{")
+				result.Close()
+			})
+
+			Convey("still relays when one syslog destination is bad", func() {
+				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
+
+				listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer listener.Close()
+
+				exec.config.SyslogAddr = "not-a-valid-address," + listener.LocalAddr().String()
+
+				go func() { time.Sleep(20 * time.Millisecond); cancel() }()
+
+				exec.relayLogs(ctx, "deadbeef123123123", map[string]string{}, result)
+
+				So(readPackets(listener), ShouldContainSubstring, "some stdout text")
+				result.Close()
+			})
+
 			Convey("shuts down after RelaySyslogStartupTime when configured", func() {
 				result, _ := os.OpenFile(tmpfn, os.O_RDWR|os.O_CREATE, 0644)
 				exec.config.RelaySyslogStartupOnly = true
 				exec.config.RelaySyslogStartupTime = 1 * time.Millisecond
 
-				// Attempt time-limited read from the channel. If we get a read,
-				// the channel closed.
-				var channelClosedSuccess bool
+				// We never cancel, so relayLogs only returns if it shut
+				// itself down
+				returned := make(chan struct{})
 				go func() {
-					select {
-					case <-quitChan:
-						channelClosedSuccess = true
-					case <-time.After(10 * time.Millisecond):
-					}
+					exec.relayLogs(context.Background(), "deadbeef123123123", map[string]string{}, result)
+					close(returned)
 				}()
 
-				exec.relayLogs(quitChan, "deadbeef123123123", map[string]string{}, result)
-				exec.config.ContainerLogsStdout = true
+				var shutDown bool
+				select {
+				case <-returned:
+					shutDown = true
+				case <-time.After(time.Second):
+				}
 
-				So(channelClosedSuccess, ShouldBeTrue)
+				So(shutDown, ShouldBeTrue)
 				resultBytes, _ := ioutil.ReadFile(tmpfn)
 				So(resultBytes, ShouldNotBeEmpty)
 			})
@@ -126,6 +446,30 @@ func Test_relayLogs(t *testing.T) {
 	}
 }
 
+func Test_handleContainerLogs(t *testing.T) {
+	Convey("handleContainerLogs()", t, func() {
+		client := &container.MockDockerClient{}
+		config, err := initConfig()
+		So(err, ShouldBeNil)
+
+		var captured bytes.Buffer
+		log.SetOutput(&captured)
+
+		exec := newSidecarExecutor(client, &docker.AuthConfiguration{}, config)
+		exec.config.RelaySyslog = true
+
+		Convey("doesn't start the log pump for tasks with NoLogRelay set", func() {
+			exec.handleContainerLogs(context.Background(), "deadbeef123123123",
+				map[string]string{"NoLogRelay": "true"})
+
+			time.Sleep(20 * time.Millisecond)
+			So(client.LastLogsOptions(), ShouldBeNil)
+			So(captured.String(), ShouldContainSubstring, "not relaying its logs")
+			So(captured.String(), ShouldNotContainSubstring, "Started syslog log pump")
+		})
+	})
+}
+
 func Test_handleOneStream(t *testing.T) {
 	Convey("handleOneStream()", t, func() {
 		fetcher := &mockFetcher{}
@@ -136,7 +480,7 @@ func Test_handleOneStream(t *testing.T) {
 		exec := newSidecarExecutor(client, &docker.AuthConfiguration{}, config)
 		exec.fetcher = fetcher
 
-		quitChan := make(chan struct{})
+		ctx := context.Background()
 		data := []byte("testing testing testing\n123\n456")
 
 		reader := bytes.NewReader(data)
@@ -154,7 +498,7 @@ func Test_handleOneStream(t *testing.T) {
 			// This test exist on EOF from the buffer
 			var captured bytes.Buffer // System log, NOT logger
 			log.SetOutput(&captured)
-			exec.handleOneStream(quitChan, "stdout", relay, reader)
+			exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, reader)
 
 			So(result.String(), ShouldContainSubstring,
 				`level=info msg="testing testing testing" SomeTag=test`)
@@ -163,11 +507,103 @@ func Test_handleOneStream(t *testing.T) {
 			So(captured.String(), ShouldNotContainSubstring, "error reading Docker")
 		})
 
+		Convey("tags each entry with the stream it came from", func() {
+			exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, reader)
+			So(result.String(), ShouldContainSubstring, "stream=stdout")
+			So(result.String(), ShouldNotContainSubstring, "stream=stderr")
+
+			result.Reset()
+			exec.handleOneStream(ctx, "deadbeef123123123", "stderr", relay, bytes.NewReader(data))
+			So(result.String(), ShouldContainSubstring, "stream=stderr")
+			So(result.String(), ShouldNotContainSubstring, "stream=stdout")
+		})
+
+		Convey("relays each stream at its configured severity", func() {
+			exec.config.RelayStdoutSeverity = "notice"
+			exec.config.RelayStderrSeverity = "warning"
+
+			exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, reader)
+			So(result.String(), ShouldContainSubstring, `level=info msg="testing testing testing" Severity=notice`)
+
+			result.Reset()
+			exec.handleOneStream(ctx, "deadbeef123123123", "stderr", relay, bytes.NewReader(data))
+			So(result.String(), ShouldContainSubstring, `level=warning msg="testing testing testing" Severity=warning`)
+		})
+
+		Convey("writes prefixed lines to stdout when RelayLogsStdout is set", func() {
+			var stdout bytes.Buffer
+			exec.relayStdout = &stdout
+			exec.config.RelayLogsStdout = true
+
+			exec.handleOneStream(ctx, "deadbeef123123123", "stderr", relay, reader)
+
+			So(stdout.String(), ShouldEqual,
+				"[deadbeef1231 stderr] testing testing testing\n"+
+					"[deadbeef1231 stderr] 123\n"+
+					"[deadbeef1231 stderr] 456\n")
+			So(result.String(), ShouldContainSubstring, "testing testing testing")
+		})
+
+		Convey("doesn't write to stdout by default", func() {
+			var stdout bytes.Buffer
+			exec.relayStdout = &stdout
+
+			exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, reader)
+
+			So(stdout.String(), ShouldBeEmpty)
+		})
+
+		Convey("when limiting the lines in flight", func() {
+			var burst strings.Builder
+			for i := 1; i <= 20; i++ {
+				fmt.Fprintf(&burst, "line %d\n", i)
+			}
+
+			hook := &slowHook{exec: exec}
+			logger.Hooks.Add(hook)
+			exec.config.RelayMaxInFlight = 3
+
+			Convey("ships every line, in order, within the limit", func() {
+				hook.delay = time.Millisecond
+
+				exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, strings.NewReader(burst.String()))
+
+				So(hook.fired, ShouldEqual, 20)
+				So(hook.maxInFlight, ShouldBeBetweenOrEqual, 1, 3)
+				So(strings.Index(result.String(), "line 1\""), ShouldBeLessThan, strings.Index(result.String(), "line 20"))
+				So(atomic.LoadInt64(&exec.relayInFlight), ShouldEqual, int64(0))
+			})
+
+			Convey("drops lines when backed up and configured to", func() {
+				var captured bytes.Buffer // System log, NOT logger
+				log.SetOutput(&captured)
+
+				hook.release = make(chan struct{})
+				exec.config.RelayOverflowPolicy = "drop"
+
+				done := make(chan struct{})
+				go func() {
+					exec.handleOneStream(ctx, "deadbeef123123123", "stdout", relay, strings.NewReader(burst.String()))
+					close(done)
+				}()
+
+				// Janky, but the burst is read long before this
+				time.Sleep(50 * time.Millisecond)
+				close(hook.release)
+				<-done
+
+				So(hook.fired, ShouldEqual, 3)
+				So(result.String(), ShouldContainSubstring, "line 3")
+				So(result.String(), ShouldNotContainSubstring, "line 4")
+				So(captured.String(), ShouldContainSubstring, "backed up, dropped 1 lines")
+			})
+		})
+
 		Convey("errors out when the name is not stderr or stdout", func() {
 			var captured bytes.Buffer // System log, NOT logger
 			log.SetOutput(&captured)
 
-			exec.handleOneStream(quitChan, "junk", relay, reader)
+			exec.handleOneStream(ctx, "deadbeef123123123", "junk", relay, reader)
 
 			So(captured.String(), ShouldContainSubstring, "Unknown stream type")
 		})
@@ -179,7 +615,7 @@ func Test_handleOneStream(t *testing.T) {
 			var captured bytes.Buffer // System log, NOT logger
 			log.SetOutput(&captured)
 
-			exec.handleOneStream(quitChan, "stderr", relay, readerWithError)
+			exec.handleOneStream(ctx, "deadbeef123123123", "stderr", relay, readerWithError)
 
 			So(result.String(), ShouldContainSubstring, `level=error msg="ERROR:`)
 			So(result.String(), ShouldContainSubstring, `level=info msg=123`)
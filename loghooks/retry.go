@@ -0,0 +1,27 @@
+package loghooks
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogRetry logs a failed attempt that we're about to retry. Every subsystem
+// logs its retries with the same fields, so operators can line up flakiness
+// in one with another. A max of zero means there's no fixed limit on the
+// attempts, and a delay of zero that we retry straight away, or can't tell
+// how long we'll wait.
+func LogRetry(subsystem string, attempt int, max int, delay time.Duration, err error) {
+	fields := logrus.Fields{
+		"Subsystem":   subsystem,
+		"Attempt":     attempt,
+		"MaxAttempts": max,
+		"Delay":       delay.String(),
+	}
+
+	if err != nil {
+		fields["Error"] = err.Error()
+	}
+
+	logrus.WithFields(fields).Warnf("Attempt %d at %s failed, retrying", attempt, subsystem)
+}
@@ -0,0 +1,39 @@
+package loghooks
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_LogRetry(t *testing.T) {
+	Convey("LogRetry()", t, func() {
+		var captured bytes.Buffer
+		logrus.SetOutput(&captured)
+		defer logrus.SetOutput(os.Stderr)
+
+		Convey("logs the retry with the same fields for every subsystem", func() {
+			LogRetry("pull", 2, 5, 200*time.Millisecond, errors.New("registry is down"))
+
+			So(captured.String(), ShouldContainSubstring, "level=warning")
+			So(captured.String(), ShouldContainSubstring, "Attempt 2 at pull failed, retrying")
+			So(captured.String(), ShouldContainSubstring, "Subsystem=pull")
+			So(captured.String(), ShouldContainSubstring, "Attempt=2")
+			So(captured.String(), ShouldContainSubstring, "MaxAttempts=5")
+			So(captured.String(), ShouldContainSubstring, "Delay=200ms")
+			So(captured.String(), ShouldContainSubstring, `Error="registry is down"`)
+		})
+
+		Convey("leaves out the error when there isn't one", func() {
+			LogRetry("sidecar", 1, 0, 0, nil)
+
+			So(captured.String(), ShouldContainSubstring, "Subsystem=sidecar")
+			So(captured.String(), ShouldNotContainSubstring, "Error=")
+		})
+	})
+}
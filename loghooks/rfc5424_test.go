@@ -0,0 +1,71 @@
+package loghooks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_RFC5424Formatter(t *testing.T) {
+	Convey("RFC5424Formatter", t, func() {
+		formatter := &RFC5424Formatter{
+			Hostname: "heorot",
+			AppName:  "beowulf",
+		}
+
+		entry := logrus.NewEntry(logrus.New())
+		entry.Time = time.Date(2021, 5, 10, 12, 30, 15, 123456000, time.UTC)
+		entry.Level = logrus.InfoLevel
+		entry.Message = "hwaet"
+
+		format := func() string {
+			line, err := formatter.Format(entry)
+			So(err, ShouldBeNil)
+			return string(line)
+		}
+
+		Convey("writes the header and the message", func() {
+			So(format(), ShouldEqual,
+				"<14>1 2021-05-10T12:30:15.123456Z heorot beowulf - - - hwaet\n")
+		})
+
+		Convey("maps the level to the syslog severity", func() {
+			entry.Level = logrus.ErrorLevel
+			So(format(), ShouldStartWith, "<11>1 ")
+		})
+
+		Convey("takes the severity from the field when there is one", func() {
+			entry.Data = logrus.Fields{SeverityField: "notice", "Team": "geats"}
+			So(format(), ShouldStartWith, "<13>1 ")
+			So(format(), ShouldContainSubstring, `[fields@32473 Team="geats"]`)
+		})
+
+		Convey("sends the fields as structured data", func() {
+			entry.Data = logrus.Fields{"Team": "geats", "Hostname": "heorot"}
+			So(format(), ShouldContainSubstring,
+				`- - [fields@32473 Hostname="heorot" Team="geats"] hwaet`)
+		})
+
+		Convey("adds the extra structured data elements", func() {
+			formatter.StructuredData = map[string]map[string]string{
+				"mesos@32473": {"Team": "geats", "Hall": "mead"},
+			}
+			So(format(), ShouldContainSubstring, `- - [mesos@32473 Hall="mead" Team="geats"] hwaet`)
+		})
+
+		Convey("escapes param values and cleans up names", func() {
+			formatter.StructuredData = map[string]map[string]string{
+				"mesos@32473": {"the king": `said "be\gone]"`},
+			}
+			So(format(), ShouldContainSubstring, `[mesos@32473 the_king="said \"be\\gone\]\""]`)
+		})
+
+		Convey("uses a dash for missing header fields", func() {
+			formatter.Hostname = ""
+			formatter.AppName = ""
+			So(format(), ShouldStartWith, "<14>1 2021-05-10T12:30:15.123456Z - - - - ")
+		})
+	})
+}
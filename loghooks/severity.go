@@ -0,0 +1,68 @@
+package loghooks
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SeverityField is the field that sets the syslog severity of an entry by
+// name, e.g. "notice", for severities that logrus has no level for. It's used
+// in place of the severity from the level, in the priority of the entry.
+const SeverityField = "Severity"
+
+var severities = map[string]int{
+	"emerg":   0,
+	"alert":   1,
+	"crit":    2,
+	"err":     3,
+	"error":   3,
+	"warning": 4,
+	"warn":    4,
+	"notice":  5,
+	"info":    6,
+	"debug":   7,
+}
+
+// ParseSeverity returns the syslog severity with the name, as used by
+// syslog(3) and logger(1). The bool is false if there's no such severity.
+func ParseSeverity(name string) (int, bool) {
+	severity, ok := severities[strings.ToLower(name)]
+	return severity, ok
+}
+
+// SeverityLevel returns the logrus level closest to the syslog severity. The
+// severities above error have no level we can log at without exiting or
+// panicking, so they're logged as errors.
+func SeverityLevel(severity int) logrus.Level {
+	switch {
+	case severity <= 3:
+		return logrus.ErrorLevel
+	case severity == 4:
+		return logrus.WarnLevel
+	case severity <= 6:
+		return logrus.InfoLevel
+	default:
+		return logrus.DebugLevel
+	}
+}
+
+// Priority returns the syslog priority of the entry, from our facility and
+// the severity named by its SeverityField, or else the one for its level
+func Priority(entry *logrus.Entry) int {
+	sev := severity(entry.Level)
+	if name, ok := entry.Data[SeverityField].(string); ok {
+		if parsed, ok := ParseSeverity(name); ok {
+			sev = parsed
+		}
+	}
+
+	return facilityUser*8 + sev
+}
+
+// withPriority prefixes the line with the priority of the entry, as the
+// syslog header would start, for formatters that don't write one
+func withPriority(entry *logrus.Entry, line string) string {
+	return fmt.Sprintf("<%d>%s", Priority(entry), line)
+}
@@ -0,0 +1,204 @@
+package loghooks
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultReconnectDelay = 1 * time.Second
+	MaxReconnectDelay     = 30 * time.Second
+
+	// Every line waits on these while the lock is held, so they have to be
+	// short enough that a blackholed collector doesn't stall the relay
+	DefaultDialTimeout  = 5 * time.Second
+	DefaultWriteTimeout = 5 * time.Second
+)
+
+// TCPHook fires loglines at a remote TCP address, one per line, in the same
+// brain-dead fashion as the UDPHook. It can optionally gzip the stream, which
+// the collector on the other end must be expecting: there is no negotiation.
+//
+// We connect on the first line, rather than up front. If the collector isn't
+// there, or goes away later, we reconnect with a backoff starting at
+// ReconnectDelay. During the outage, up to BufferLines lines are held and sent
+// once we're connected again. Anything beyond that is dropped. Connecting is
+// bounded by DialTimeout, and each write by WriteTimeout. AddPriority works as
+// it does for the UDPHook.
+type TCPHook struct {
+	Conn           net.Conn
+	RemoteAddr     string
+	Compress       bool
+	AddPriority    bool
+	ReconnectDelay time.Duration
+	BufferLines    int
+	DialTimeout    time.Duration
+	WriteTimeout   time.Duration
+
+	lock       sync.Mutex
+	gz         *gzip.Writer
+	buffer     []string
+	retryDelay time.Duration
+	nextRetry  time.Time
+}
+
+// NewTCPHook returns a hook for the collector at raddr. It doesn't connect
+// yet, so only a malformed address is an error.
+func NewTCPHook(raddr string, compress bool) (*TCPHook, error) {
+	_, _, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collector address '%s': %s", raddr, err)
+	}
+
+	return &TCPHook{
+		RemoteAddr:     raddr,
+		Compress:       compress,
+		ReconnectDelay: DefaultReconnectDelay,
+		DialTimeout:    DefaultDialTimeout,
+		WriteTimeout:   DefaultWriteTimeout,
+	}, nil
+}
+
+func (hook *TCPHook) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read entry: %s", err)
+		return fmt.Errorf("error reading entry: %s", err)
+	}
+
+	if hook.AddPriority {
+		line = withPriority(entry, line)
+	}
+
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+
+	// We're in an outage, and it's not time to try again yet
+	if hook.Conn == nil && !hook.reconnect() {
+		hook.hold(line)
+		return nil
+	}
+
+	// Send anything we held during the outage first, to keep the order
+	for len(hook.buffer) > 0 {
+		err = hook.write(hook.buffer[0])
+		if err != nil {
+			hook.lostConnection(err)
+			hook.hold(line)
+			return nil
+		}
+		hook.buffer = hook.buffer[1:]
+	}
+
+	err = hook.write(line)
+	if err != nil {
+		hook.lostConnection(err)
+		hook.hold(line)
+		return fmt.Errorf("error writing entry: %s", err)
+	}
+
+	return nil
+}
+
+func (hook *TCPHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// connect dials the collector. Each connection gets its own gzip stream, since
+// the collector can't pick up a stream part way through.
+func (hook *TCPHook) connect() error {
+	conn, err := net.DialTimeout("tcp", hook.RemoteAddr, hook.DialTimeout)
+	if err != nil {
+		return err
+	}
+
+	hook.Conn = conn
+	if hook.Compress {
+		hook.gz = gzip.NewWriter(conn)
+	}
+
+	return nil
+}
+
+// reconnect tries to connect again, if the backoff allows. Returns whether
+// we're now connected.
+func (hook *TCPHook) reconnect() bool {
+	if time.Now().Before(hook.nextRetry) {
+		return false
+	}
+
+	err := hook.connect()
+	if err != nil {
+		// The first failure, e.g. when the collector is down as we start up,
+		// waits ReconnectDelay, and each one after that twice as long
+		if hook.retryDelay < hook.ReconnectDelay {
+			fmt.Fprintf(os.Stderr, "Unable to connect to %s, retrying: %s\n", hook.RemoteAddr, err)
+			hook.retryDelay = hook.ReconnectDelay
+		} else {
+			hook.retryDelay *= 2
+		}
+		if hook.retryDelay > MaxReconnectDelay {
+			hook.retryDelay = MaxReconnectDelay
+		}
+		hook.nextRetry = time.Now().Add(hook.retryDelay)
+		return false
+	}
+
+	if hook.retryDelay > 0 {
+		fmt.Fprintf(os.Stderr, "Reconnected to %s\n", hook.RemoteAddr)
+	}
+	hook.retryDelay = 0
+	return true
+}
+
+// lostConnection closes the broken connection and schedules the first retry
+func (hook *TCPHook) lostConnection(err error) {
+	fmt.Fprintf(os.Stderr, "Lost connection to %s, reconnecting: %s\n", hook.RemoteAddr, err)
+
+	hook.Conn.Close()
+	hook.Conn = nil
+	hook.gz = nil
+
+	hook.retryDelay = hook.ReconnectDelay
+	hook.nextRetry = time.Now().Add(hook.retryDelay)
+}
+
+// hold keeps a line to send after we reconnect, dropping the oldest line if
+// the buffer is full
+func (hook *TCPHook) hold(line string) {
+	if hook.BufferLines < 1 {
+		return
+	}
+
+	if len(hook.buffer) >= hook.BufferLines {
+		hook.buffer = hook.buffer[1:]
+	}
+	hook.buffer = append(hook.buffer, line)
+}
+
+func (hook *TCPHook) write(line string) error {
+	if hook.WriteTimeout > 0 {
+		err := hook.Conn.SetWriteDeadline(time.Now().Add(hook.WriteTimeout))
+		if err != nil {
+			return err
+		}
+	}
+
+	if hook.gz != nil {
+		_, err := hook.gz.Write([]byte(line))
+		if err != nil {
+			return err
+		}
+		// Flush each line so the collector isn't left waiting on a block
+		return hook.gz.Flush()
+	}
+
+	_, err := hook.Conn.Write([]byte(line))
+	return err
+}
@@ -0,0 +1,209 @@
+package loghooks
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// collector accepts connections and sends every line it reads to lines
+type collector struct {
+	listener net.Listener
+	conns    chan net.Conn
+	lines    chan string
+}
+
+func newCollector(addr string) (*collector, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &collector{
+		listener: listener,
+		conns:    make(chan net.Conn, 10),
+		lines:    make(chan string, 100),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.conns <- conn
+
+			go func() {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return c, nil
+}
+
+// stop closes the listener and every connection it accepted
+func (c *collector) stop() {
+	c.listener.Close()
+	for {
+		select {
+		case conn := <-c.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// waitFor reads lines until one contains text, or we give up
+func (c *collector) waitFor(text string) bool {
+	for {
+		select {
+		case line := <-c.lines:
+			if strings.Contains(line, text) {
+				return true
+			}
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+}
+
+func Test_TCPHook(t *testing.T) {
+	Convey("TCPHook", t, func() {
+		server, err := newCollector("127.0.0.1:0")
+		So(err, ShouldBeNil)
+		addr := server.listener.Addr().String()
+
+		hook, err := NewTCPHook(addr, false)
+		So(err, ShouldBeNil)
+		hook.ReconnectDelay = 10 * time.Millisecond
+
+		logger := logrus.New()
+		logger.Hooks.Add(hook)
+		logger.SetOutput(&strings.Builder{})
+
+		// The hook connects on the first line
+		logger.Info("hello")
+		So(server.waitFor("hello"), ShouldBeTrue)
+
+		// Stop the collector, and log until the hook notices it's gone
+		restartCollector := func() {
+			server.stop()
+			for i := 0; i < 100 && hook.Conn != nil; i++ {
+				logger.Info("into the void")
+				time.Sleep(5 * time.Millisecond)
+			}
+			So(hook.Conn, ShouldBeNil)
+
+			server, err = newCollector(addr)
+			So(err, ShouldBeNil)
+		}
+
+		Reset(func() { server.stop() })
+
+		Convey("delivers log lines", func() {
+			logger.Info("hwaet")
+			So(server.waitFor("hwaet"), ShouldBeTrue)
+		})
+
+		Convey("starts lines with their syslog priority when asked", func() {
+			hook.AddPriority = true
+
+			logger.WithField(SeverityField, "notice").Info("hwaet")
+			So(server.waitFor("<13>time="), ShouldBeTrue)
+
+			logger.Error("unferth")
+			So(server.waitFor("<11>time="), ShouldBeTrue)
+		})
+
+		Convey("sets deadlines on connecting and writing", func() {
+			So(hook.DialTimeout, ShouldEqual, DefaultDialTimeout)
+			So(hook.WriteTimeout, ShouldEqual, DefaultWriteTimeout)
+		})
+
+		Convey("keeps retrying when the collector is down at startup", func() {
+			server.stop()
+
+			hook, err := NewTCPHook(addr, false)
+			So(err, ShouldBeNil)
+			hook.ReconnectDelay = 10 * time.Millisecond
+			hook.BufferLines = 10
+
+			logger := logrus.New()
+			logger.Hooks.Add(hook)
+			logger.SetOutput(&strings.Builder{})
+
+			logger.Info("too early")
+			So(hook.Conn, ShouldBeNil)
+
+			server, err = newCollector(addr)
+			So(err, ShouldBeNil)
+
+			time.Sleep(2 * hook.ReconnectDelay)
+			logger.Info("back again")
+
+			So(server.waitFor("too early"), ShouldBeTrue)
+			So(server.waitFor("back again"), ShouldBeTrue)
+		})
+
+		Convey("rejects a malformed address", func() {
+			_, err := NewTCPHook("beowulf", false)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("resumes delivery after the collector restarts", func() {
+			restartCollector()
+
+			time.Sleep(2 * hook.ReconnectDelay)
+			logger.Info("back again")
+
+			So(server.waitFor("back again"), ShouldBeTrue)
+		})
+
+		Convey("drops lines logged during the outage by default", func() {
+			restartCollector()
+
+			logger.Info("lost at sea")
+			time.Sleep(2 * hook.ReconnectDelay)
+			logger.Info("back again")
+
+			So(server.waitFor("lost at sea"), ShouldBeFalse)
+		})
+
+		Convey("sends buffered lines after reconnecting", func() {
+			hook.BufferLines = 10
+			restartCollector()
+
+			logger.Info("held over")
+			time.Sleep(2 * hook.ReconnectDelay)
+			logger.Info("back again")
+
+			So(server.waitFor("held over"), ShouldBeTrue)
+			So(server.waitFor("back again"), ShouldBeTrue)
+		})
+
+		Convey("drops the oldest lines when the buffer is full", func() {
+			hook.BufferLines = 1
+			restartCollector()
+
+			// Make sure we don't reconnect while filling the buffer
+			hook.nextRetry = time.Now().Add(time.Hour)
+			logger.Info("first")
+			logger.Info("second")
+			hook.nextRetry = time.Now()
+			logger.Info("back again")
+
+			So(server.waitFor("second"), ShouldBeTrue)
+			So(hook.buffer, ShouldBeEmpty)
+		})
+	})
+}
@@ -12,14 +12,18 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// UDPHook fires each line at RemoteAddr in its own packet. With AddPriority,
+// each line starts with its syslog priority, e.g. <13>, so that the collector
+// can tell its severity even when the formatter doesn't write a syslog header.
 type UDPHook struct {
-	Conn       net.Conn
-	RemoteAddr string
+	Conn        net.Conn
+	RemoteAddr  string
+	AddPriority bool
 }
 
 func NewUDPHook(raddr string) (*UDPHook, error) {
 	conn, err := net.Dial("udp", raddr)
-	return &UDPHook{conn, raddr}, err
+	return &UDPHook{Conn: conn, RemoteAddr: raddr}, err
 }
 
 func (hook *UDPHook) Fire(entry *logrus.Entry) error {
@@ -29,6 +33,10 @@ func (hook *UDPHook) Fire(entry *logrus.Entry) error {
 		return fmt.Errorf("error reading entry: %s", err)
 	}
 
+	if hook.AddPriority {
+		line = withPriority(entry, line)
+	}
+
 	_, err = hook.Conn.Write([]byte(line))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to write entry: %s", err)
@@ -2,11 +2,16 @@ package main
 
 import (
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"reflect"
 	"sort"
 	"strings"
@@ -14,6 +19,8 @@ import (
 	"time"
 	"unsafe"
 
+	"github.com/Nitro/sidecar-executor/container"
+	"github.com/Nitro/sidecar-executor/loghooks"
 	"github.com/Nitro/sidecar-executor/mesosdriver"
 	"github.com/Nitro/sidecar/service"
 	docker "github.com/fsouza/go-dockerclient"
@@ -27,6 +34,8 @@ const (
 	TaskFinished = iota
 	TaskFailed   = iota
 	TaskKilled   = iota
+	TaskKilling  = iota
+	TaskError    = iota
 )
 
 const (
@@ -36,19 +45,64 @@ const (
 type Config struct {
 	KillTaskTimeout         uint          `envconfig:"KILL_TASK_TIMEOUT" default:"5"` // Seconds
 	HttpTimeout             time.Duration `envconfig:"HTTP_TIMEOUT" default:"2s"`
+	HttpKeepAlive           time.Duration `envconfig:"HTTP_KEEP_ALIVE" default:"30s"`
+	HttpMaxIdleConns        int           `envconfig:"HTTP_MAX_IDLE_CONNS" default:"4"`
+	HttpIdleConnTimeout     time.Duration `envconfig:"HTTP_IDLE_CONN_TIMEOUT" default:"90s"`
 	SidecarRetryCount       int           `envconfig:"SIDECAR_RETRY_COUNT" default:"5"`
 	SidecarRetryDelay       time.Duration `envconfig:"SIDECAR_RETRY_DELAY" default:"3s"`
-	SidecarUrl              string        `envconfig:"SIDECAR_URL" default:"http://localhost:7777/state.json"`
+	SidecarUrl              string        `envconfig:"SIDECAR_URL" default:"http://localhost:7777"`
+	SidecarStatePath        string        `envconfig:"SIDECAR_STATE_PATH" default:"/state.json"`
+	SidecarServicePath      string        `envconfig:"SIDECAR_SERVICE_PATH" default:"Servers.{host}.Services.{id}"`
 	SidecarBackoff          time.Duration `envconfig:"SIDECAR_BACKOFF" default:"1m"`
+	SidecarImmediateCheck   bool          `envconfig:"SIDECAR_IMMEDIATE_CHECK" default:"false"`
+	SidecarWaitDockerHealth bool          `envconfig:"SIDECAR_WAIT_DOCKER_HEALTH" default:"false"`
 	SidecarPollInterval     time.Duration `envconfig:"SIDECAR_POLL_INTERVAL" default:"30s"`
+	SidecarPollJitter       time.Duration `envconfig:"SIDECAR_POLL_JITTER" default:"0s"`
 	SidecarMaxFails         int           `envconfig:"SIDECAR_MAX_FAILS" default:"3"`
+	SidecarSuccessThreshold int           `envconfig:"SIDECAR_SUCCESS_THRESHOLD" default:"1"`
+	SidecarOnUnknown        string        `envconfig:"SIDECAR_ON_UNKNOWN" default:"healthy"`
 	SidecarDrainingDuration time.Duration `envconfig:"SIDECAR_DRAINING_DURATION" default:"10s"`
+	SidecarDiscoveryTimeout time.Duration `envconfig:"SIDECAR_DISCOVERY_TIMEOUT" default:"0s"`
+	SidecarIdLength         int           `envconfig:"SIDECAR_ID_LENGTH" default:"12"`
+	RestartOnUnhealthy      bool          `envconfig:"RESTART_ON_UNHEALTHY" default:"false"`
+	OnUnhealthy             string        `envconfig:"ON_UNHEALTHY" default:"fail"`
+	DrainQuietPeriod        time.Duration `envconfig:"DRAIN_QUIET_PERIOD" default:"30s"`
+	KillGracePeriod         time.Duration `envconfig:"KILL_GRACE_PERIOD" default:"0s"`
+	ForceRemoveStuck        bool          `envconfig:"FORCE_REMOVE_STUCK" default:"false"`
+	PostStopCommand         string        `envconfig:"POST_STOP_COMMAND" default:""`
+	PostStopTimeout         time.Duration `envconfig:"POST_STOP_TIMEOUT" default:"30s"`
+	MinHealthyDuration      time.Duration `envconfig:"MIN_HEALTHY_DURATION" default:"0s"`
+	MissingContainerGrace   time.Duration `envconfig:"MISSING_CONTAINER_GRACE" default:"0s"`
+	ReadinessRetryCount     int           `envconfig:"READINESS_RETRY_COUNT" default:"30"`
+	ReadinessRetryDelay     time.Duration `envconfig:"READINESS_RETRY_DELAY" default:"1s"`
+	ReadinessTimeout        time.Duration `envconfig:"READINESS_TIMEOUT" default:"1s"`
 	SeedSidecar             bool          `envconfig:"SEED_SIDECAR" default:"false"`
 	DockerRepository        string        `envconfig:"DOCKER_REPOSITORY" default:"https://index.docker.io/v1/"`
+	DockerApiVersion        string        `envconfig:"DOCKER_API_VERSION" default:""`
+	DockerTimeout           time.Duration `envconfig:"DOCKER_TIMEOUT" default:"10s"`
+	DockerHealthInterval    time.Duration `envconfig:"DOCKER_HEALTH_INTERVAL" default:"1s"`
+	DockerReconnectTimeout  time.Duration `envconfig:"DOCKER_RECONNECT_TIMEOUT" default:"0s"`
+	DockerReconnectDelay    time.Duration `envconfig:"DOCKER_RECONNECT_DELAY" default:"1s"`
+	DockerErrorRetries      int           `envconfig:"DOCKER_ERROR_RETRIES" default:"0"`
+	PullStallTimeout        time.Duration `envconfig:"PULL_STALL_TIMEOUT" default:"0s"`
+	DockerMaxFailures       int           `envconfig:"DOCKER_MAX_FAILURES" default:"3"`
+	ImageAllowlist          []string      `envconfig:"IMAGE_ALLOWLIST" default:""`
+	LaunchRetryCount        int           `envconfig:"LAUNCH_RETRY_COUNT" default:"2"`
+	LaunchRetryDelay        time.Duration `envconfig:"LAUNCH_RETRY_DELAY" default:"1s"`
 	LogsSince               time.Duration `envconfig:"LOGS_SINCE" default:"3m"`
+	CaptureFsChanges        bool          `envconfig:"CAPTURE_FS_CHANGES" default:"false"`
+	ForwardExitCode         bool          `envconfig:"FORWARD_EXIT_CODE" default:"false"`
 	ForceCpuLimit           bool          `envconfig:"FORCE_CPU_LIMIT" default:"false"`
 	ForceMemoryLimit        bool          `envconfig:"FORCE_MEMORY_LIMIT" default:"false"`
+	MemorySwapMultiplier    float64       `envconfig:"MEMORY_SWAP_MULTIPLIER" default:"1"`
+	ForceDiskLimit          bool          `envconfig:"FORCE_DISK_LIMIT" default:"false"`
 	UseCpuShares            bool          `envconfig:"USE_CPU_SHARES" default:"false"`
+	AutoRemove              bool          `envconfig:"AUTO_REMOVE" default:"false"`
+	CgroupParent            string        `envconfig:"CGROUP_PARENT" default:""`
+	PortHostIP              string        `envconfig:"PORT_HOST_IP" default:""`
+	LogMaxSize              string        `envconfig:"LOG_MAX_SIZE" default:""`
+	LogMaxFile              int           `envconfig:"LOG_MAX_FILE" default:"0"`
+	HealthAddr              string        `envconfig:"HEALTH_ADDR" default:""`
 	Debug                   bool          `envconfig:"DEBUG" default:"false"`
 
 	// AWS Role options
@@ -63,18 +117,40 @@ type Config struct {
 	RelaySyslog            bool          `envconfig:"RELAY_SYSLOG" default:"false"`
 	RelaySyslogStartupOnly bool          `envconfig:"RELAY_SYSLOG_STARTUP_ONLY" default:"false"`
 	RelaySyslogStartupTime time.Duration `envconfig:"RELAY_SYSLOG_STARTUP_TIME" default:"1m"`
+	RelaySyslogWhenHealthy bool          `envconfig:"RELAY_SYSLOG_WHEN_HEALTHY" default:"false"`
+	RelaySyslogTail        string        `envconfig:"RELAY_SYSLOG_TAIL" default:"all"`
+	RelaySyslogAttachTail  string        `envconfig:"RELAY_SYSLOG_ATTACH_TAIL" default:""`
+	RelaySyslogAttachSince time.Duration `envconfig:"RELAY_SYSLOG_ATTACH_SINCE" default:"0s"`
+	RelaySyslogStreams     string        `envconfig:"RELAY_SYSLOG_STREAMS" default:"both"`
+	RelayStdoutSeverity    string        `envconfig:"RELAY_STDOUT_SEVERITY" default:""`
+	RelayStderrSeverity    string        `envconfig:"RELAY_STDERR_SEVERITY" default:""`
+	RelayMaxInFlight       int           `envconfig:"RELAY_MAX_IN_FLIGHT" default:"0"`
+	RelayOverflowPolicy    string        `envconfig:"RELAY_OVERFLOW_POLICY" default:"block"`
+	RelayRestartCount      int           `envconfig:"RELAY_RESTART_COUNT" default:"3"`
+	RelayRestartDelay      time.Duration `envconfig:"RELAY_RESTART_DELAY" default:"1s"`
 	SyslogAddr             string        `envconfig:"SYSLOG_ADDR" default:"127.0.0.1:514"`
+	SyslogFormat           string        `envconfig:"SYSLOG_FORMAT" default:"json"`
+	SyslogCompress         bool          `envconfig:"SYSLOG_COMPRESS" default:"false"`
+	SyslogReconnectDelay   time.Duration `envconfig:"SYSLOG_RECONNECT_DELAY" default:"1s"`
+	SyslogBufferLines      int           `envconfig:"SYSLOG_BUFFER_LINES" default:"0"`
 	ContainerLogsStdout    bool          `envconfig:"CONTAINER_LOGS_STDOUT" default:"false"`
+	RelayLogsStdout        bool          `envconfig:"RELAY_LOGS_STDOUT" default:"false"`
 	SendDockerLabels       []string      `envconfig:"SEND_DOCKER_LABELS" default:""`
+	RedactEnvPatterns      []string      `envconfig:"REDACT_ENV_PATTERNS" default:"*SECRET*,*PASSWORD*,*_TOKEN"`
 	LogHostname            string        `envconfig:"LOG_HOSTNAME"` // Name we log as
 }
 
+// SidecarServer is the subset of a server entry from the Sidecar state that
+// we care about. Anything else Sidecar sends is ignored.
 type SidecarServer struct {
-	Services map[string]service.Service
+	Name     string                     `json:"Name"`
+	Services map[string]service.Service `json:"Services"`
 }
 
+// SidecarServices is the subset of the Sidecar state (`/state.json`) that we
+// need in order to health check our own container.
 type SidecarServices struct {
-	Servers map[string]SidecarServer
+	Servers map[string]SidecarServer `json:"Servers"`
 }
 
 type SidecarFetcher interface {
@@ -86,28 +162,90 @@ func logConfig(config Config) {
 	log.Infof("Executor Config -----------------------")
 	log.Infof(" * KillTaskTimeout:         %d", config.KillTaskTimeout)
 	log.Infof(" * HttpTimeout:             %s", config.HttpTimeout.String())
+	log.Infof(" * HttpKeepAlive:           %s", config.HttpKeepAlive.String())
+	log.Infof(" * HttpMaxIdleConns:        %d", config.HttpMaxIdleConns)
+	log.Infof(" * HttpIdleConnTimeout:     %s", config.HttpIdleConnTimeout.String())
 	log.Infof(" * SidecarRetryCount:       %d", config.SidecarRetryCount)
 	log.Infof(" * SidecarRetryDelay:       %s", config.SidecarRetryDelay.String())
-	log.Infof(" * SidecarUrl:              %s", config.SidecarUrl)
+	log.Infof(" * SidecarUrl:              %s", redactUrl(config.SidecarUrl))
+	log.Infof(" * SidecarStatePath:        %s", config.SidecarStatePath)
+	log.Infof(" * SidecarServicePath:      %s", config.SidecarServicePath)
 	log.Infof(" * SidecarBackoff:          %s", config.SidecarBackoff.String())
+	log.Infof(" * SidecarImmediateCheck:   %t", config.SidecarImmediateCheck)
+	log.Infof(" * SidecarWaitDockerHealth: %t", config.SidecarWaitDockerHealth)
 	log.Infof(" * SidecarPollInterval:     %s", config.SidecarPollInterval.String())
+	log.Infof(" * SidecarPollJitter:       %s", config.SidecarPollJitter.String())
 	log.Infof(" * SidecarMaxFails:         %d", config.SidecarMaxFails)
+	log.Infof(" * SidecarSuccessThreshold: %d", config.SidecarSuccessThreshold)
+	log.Infof(" * SidecarOnUnknown:        %s", config.SidecarOnUnknown)
 	log.Infof(" * SidecarDrainingDuration: %s", config.SidecarDrainingDuration)
+	log.Infof(" * SidecarDiscoveryTimeout: %s", config.SidecarDiscoveryTimeout)
+	log.Infof(" * SidecarIdLength:         %d", config.SidecarIdLength)
+	log.Infof(" * RestartOnUnhealthy:      %t", config.RestartOnUnhealthy)
+	log.Infof(" * OnUnhealthy:             %s", config.OnUnhealthy)
+	log.Infof(" * DrainQuietPeriod:        %s", config.DrainQuietPeriod.String())
+	log.Infof(" * KillGracePeriod:         %s", config.KillGracePeriod.String())
+	log.Infof(" * ForceRemoveStuck:        %t", config.ForceRemoveStuck)
+	log.Infof(" * PostStopCommand:         %s", redactConfig(config, "PostStopCommand", config.PostStopCommand))
+	log.Infof(" * PostStopTimeout:         %s", config.PostStopTimeout.String())
+	log.Infof(" * MinHealthyDuration:      %s", config.MinHealthyDuration.String())
+	log.Infof(" * MissingContainerGrace:   %s", config.MissingContainerGrace.String())
+	log.Infof(" * ReadinessRetryCount:     %d", config.ReadinessRetryCount)
+	log.Infof(" * ReadinessRetryDelay:     %s", config.ReadinessRetryDelay.String())
+	log.Infof(" * ReadinessTimeout:        %s", config.ReadinessTimeout.String())
 	log.Infof(" * SeedSidecar:             %t", config.SeedSidecar)
 	log.Infof(" * DockerRepository:        %s", config.DockerRepository)
+	log.Infof(" * DockerApiVersion:        %s", config.DockerApiVersion)
+	log.Infof(" * DockerTimeout:           %s", config.DockerTimeout.String())
+	log.Infof(" * DockerHealthInterval:    %s", config.DockerHealthInterval.String())
+	log.Infof(" * DockerReconnectTimeout:  %s", config.DockerReconnectTimeout.String())
+	log.Infof(" * DockerReconnectDelay:    %s", config.DockerReconnectDelay.String())
+	log.Infof(" * DockerErrorRetries:      %d", config.DockerErrorRetries)
+	log.Infof(" * PullStallTimeout:        %s", config.PullStallTimeout.String())
+	log.Infof(" * DockerMaxFailures:       %d", config.DockerMaxFailures)
+	log.Infof(" * ImageAllowlist:          %v", config.ImageAllowlist)
+	log.Infof(" * LaunchRetryCount:        %d", config.LaunchRetryCount)
+	log.Infof(" * LaunchRetryDelay:        %s", config.LaunchRetryDelay.String())
 	log.Infof(" * LogsSince:               %s", config.LogsSince.String())
+	log.Infof(" * CaptureFsChanges:        %t", config.CaptureFsChanges)
+	log.Infof(" * ForwardExitCode:         %t", config.ForwardExitCode)
 	log.Infof(" * ForceCpuLimit:           %t", config.ForceCpuLimit)
 	log.Infof(" * ForceMemoryLimit:        %t", config.ForceMemoryLimit)
+	log.Infof(" * MemorySwapMultiplier:    %.2f", config.MemorySwapMultiplier)
+	log.Infof(" * ForceDiskLimit:          %t", config.ForceDiskLimit)
 	log.Infof(" * UseCpuShares:            %t", config.UseCpuShares)
+	log.Infof(" * AutoRemove:              %t", config.AutoRemove)
+	log.Infof(" * CgroupParent:            %s", config.CgroupParent)
+	log.Infof(" * PortHostIP:              %s", config.PortHostIP)
+	log.Infof(" * LogMaxSize:              %s", config.LogMaxSize)
+	log.Infof(" * LogMaxFile:              %d", config.LogMaxFile)
+	log.Infof(" * HealthAddr:              %s", config.HealthAddr)
 	log.Infof(" * MesosMasterPort:         %s", config.MesosMasterPort)
 	log.Infof(" * RelaySyslog:             %t", config.RelaySyslog)
 	log.Infof(" * RelaySyslogStartupOnly:  %t", config.RelaySyslogStartupOnly)
 	log.Infof(" * RelaySyslogStartupTime:  %s", config.RelaySyslogStartupTime.String())
-	log.Infof(" * SyslogAddr:              %s", config.SyslogAddr)
+	log.Infof(" * RelaySyslogWhenHealthy:  %t", config.RelaySyslogWhenHealthy)
+	log.Infof(" * RelaySyslogTail:         %s", config.RelaySyslogTail)
+	log.Infof(" * RelaySyslogAttachTail:   %s", config.RelaySyslogAttachTail)
+	log.Infof(" * RelaySyslogAttachSince:  %s", config.RelaySyslogAttachSince.String())
+	log.Infof(" * RelaySyslogStreams:      %s", config.RelaySyslogStreams)
+	log.Infof(" * RelayStdoutSeverity:     %s", config.RelayStdoutSeverity)
+	log.Infof(" * RelayStderrSeverity:     %s", config.RelayStderrSeverity)
+	log.Infof(" * RelayMaxInFlight:        %d", config.RelayMaxInFlight)
+	log.Infof(" * RelayOverflowPolicy:     %s", config.RelayOverflowPolicy)
+	log.Infof(" * RelayRestartCount:       %d", config.RelayRestartCount)
+	log.Infof(" * RelayRestartDelay:       %s", config.RelayRestartDelay.String())
+	log.Infof(" * SyslogAddr:              %s", redactConfig(config, "SyslogAddr", config.SyslogAddr))
+	log.Infof(" * SyslogFormat:            %s", config.SyslogFormat)
+	log.Infof(" * SyslogCompress:          %t", config.SyslogCompress)
+	log.Infof(" * SyslogReconnectDelay:    %s", config.SyslogReconnectDelay.String())
+	log.Infof(" * SyslogBufferLines:       %d", config.SyslogBufferLines)
 	log.Infof(" * ContainerLogsStdout:     %t", config.ContainerLogsStdout)
+	log.Infof(" * RelayLogsStdout:         %t", config.RelayLogsStdout)
 	log.Infof(" * SendDockerLabels:        %v", config.SendDockerLabels)
+	log.Infof(" * RedactEnvPatterns:       %v", config.RedactEnvPatterns)
 	log.Infof(" * LogHostname:             %s", config.LogHostname)
-	log.Infof(" * AWSRole:                 %s", config.AWSRole)
+	log.Infof(" * AWSRole:                 %s", redactConfig(config, "AWSRole", config.AWSRole))
 	log.Infof(" * AWSRoleTTL:              %s", config.AWSRoleTTL)
 	log.Infof(" * AWSRoleMaxTTL:           %s", config.AWSRoleMaxTTL)
 	log.Infof(" * Debug:                   %t", config.Debug)
@@ -128,13 +266,80 @@ func logConfig(config Config) {
 			strings.HasPrefix(setting, "VAULT") ||
 			(setting == "HOME") {
 
-			pair := strings.Split(setting, "=")
+			pair := strings.SplitN(redactSetting(setting, config.RedactEnvPatterns), "=", 2)
 			log.Infof(" * %-30s: %s", pair[0], pair[1])
 		}
 	}
 	log.Infof("---------------------------------------")
 }
 
+// logConfigSummary emits a single structured log entry containing every
+// effective config setting, after the env has been applied. This is much
+// easier to find and parse in a log aggregator than the output of logConfig().
+func logConfigSummary(config Config) {
+	v := reflect.ValueOf(config)
+	fields := make(log.Fields, v.NumField())
+
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		value := v.Field(i).Interface()
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+		if !v.Field(i).IsZero() && shouldRedactConfig(config, name) {
+			value = "[REDACTED]"
+		}
+		fields[name] = value
+	}
+
+	// The Sidecar URL could contain basic auth credentials
+	fields["SidecarUrl"] = redactUrl(config.SidecarUrl)
+
+	log.WithFields(fields).Info("Effective executor config")
+}
+
+// sensitiveConfigFields are the settings we don't log, along with any whose
+// names match the RedactEnvPatterns. Syslog addresses and the post-stop
+// command may contain credentials, and the AWS role is what we assume to get
+// them.
+var sensitiveConfigFields = []string{"AWSRole", "SyslogAddr", "PostStopCommand"}
+
+// shouldRedactConfig reports whether the named config setting is sensitive
+func shouldRedactConfig(config Config, name string) bool {
+	for _, field := range sensitiveConfigFields {
+		if field == name {
+			return true
+		}
+	}
+
+	return shouldRedact(name, config.RedactEnvPatterns)
+}
+
+// redactConfig masks the value of the named config setting if it's
+// sensitive. Unset values are left alone, so the log shows they're unset.
+func redactConfig(config Config, name string, value string) string {
+	if value == "" || !shouldRedactConfig(config, name) {
+		return value
+	}
+
+	return "[REDACTED]"
+}
+
+// redactUrl strips the password from a URL, if it has one, so that it's safe
+// to log.
+func redactUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || parsed.User == nil {
+		return rawUrl
+	}
+
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = url.UserPassword(parsed.User.Username(), "REDACTED")
+	}
+
+	return parsed.String()
+}
+
 func shouldSkipLogging(setting string) bool {
 	return strings.HasPrefix(setting, "VAULT_TOKEN=") ||
 		strings.HasPrefix(setting, "VAULT_USERNAME=") ||
@@ -213,7 +418,7 @@ func handleSignals(scExec *sidecarExecutor) {
 		// Signal to monitorTask() to exit
 		if sig == syscall.SIGUSR1 {
 			// Intentionally invoked clean shutdown
-			scExec.watchLooper.Quit()
+			scExec.stopWatching()
 			exitCode = 0
 		} else {
 			scExec.watchLooper.Done(errors.New("Got " + sig.String() + " signal!"))
@@ -223,9 +428,9 @@ func handleSignals(scExec *sidecarExecutor) {
 		scExec.watcherWg.Wait()
 	}
 
-	// Shut down log pump if running
-	if scExec.logsQuitChan != nil {
-		close(scExec.logsQuitChan) // Signal loops to exit
+	// Shut down log pump and anything else still watching the task
+	if scExec.cancelTask != nil {
+		scExec.cancelTask()
 	}
 
 	time.Sleep(3 * time.Second) // Try to let it quit
@@ -245,6 +450,109 @@ func initConfig() (Config, error) {
 		config.LogHostname = hostname
 	}
 
+	switch config.RelaySyslogStreams {
+	case "both", "stdout", "stderr":
+	default:
+		return Config{}, fmt.Errorf(
+			"RelaySyslogStreams must be one of 'both', 'stdout', or 'stderr', not '%s'",
+			config.RelaySyslogStreams,
+		)
+	}
+
+	if config.RelaySyslogWhenHealthy && config.RelaySyslogStartupOnly {
+		return Config{}, errors.New(
+			"RelaySyslogWhenHealthy can't be combined with RelaySyslogStartupOnly",
+		)
+	}
+
+	switch config.SyslogFormat {
+	case "json", "rfc5424":
+	default:
+		return Config{}, fmt.Errorf(
+			"SyslogFormat must be one of 'json' or 'rfc5424', not '%s'",
+			config.SyslogFormat,
+		)
+	}
+
+	switch config.OnUnhealthy {
+	case "fail", "pause":
+	default:
+		return Config{}, fmt.Errorf(
+			"OnUnhealthy must be one of 'fail' or 'pause', not '%s'",
+			config.OnUnhealthy,
+		)
+	}
+
+	switch config.SidecarOnUnknown {
+	case "healthy", "unhealthy", "retry":
+	default:
+		return Config{}, fmt.Errorf(
+			"SidecarOnUnknown must be one of 'healthy', 'unhealthy', or 'retry', not '%s'",
+			config.SidecarOnUnknown,
+		)
+	}
+
+	if !strings.Contains(config.SidecarServicePath, "{id}") {
+		return Config{}, fmt.Errorf(
+			"SidecarServicePath must contain '{id}', not '%s'",
+			config.SidecarServicePath,
+		)
+	}
+
+	switch config.RelayOverflowPolicy {
+	case "block", "drop":
+	default:
+		return Config{}, fmt.Errorf(
+			"RelayOverflowPolicy must be one of 'block' or 'drop', not '%s'",
+			config.RelayOverflowPolicy,
+		)
+	}
+
+	if config.SidecarSuccessThreshold < 1 {
+		return Config{}, fmt.Errorf(
+			"SidecarSuccessThreshold must be at least 1, not %d", config.SidecarSuccessThreshold,
+		)
+	}
+
+	if config.DockerErrorRetries < 0 {
+		return Config{}, fmt.Errorf(
+			"DockerErrorRetries can't be negative, not %d", config.DockerErrorRetries,
+		)
+	}
+
+	// Both retry the same Docker errors, and together they'd multiply
+	if config.DockerErrorRetries > 0 && config.DockerReconnectTimeout > 0 {
+		return Config{}, errors.New("DockerErrorRetries and DockerReconnectTimeout can't be combined")
+	}
+
+	for _, severity := range []string{config.RelayStdoutSeverity, config.RelayStderrSeverity} {
+		if _, ok := loghooks.ParseSeverity(severity); severity != "" && !ok {
+			return Config{}, fmt.Errorf("Invalid syslog severity '%s'", severity)
+		}
+	}
+
+	for _, pattern := range config.ImageAllowlist {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Config{}, fmt.Errorf("Invalid image allowlist pattern '%s': %s", pattern, err)
+		}
+	}
+
+	if config.CgroupParent != "" {
+		err = container.ValidateCgroupParent(config.CgroupParent)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	if config.PortHostIP != "" && net.ParseIP(config.PortHostIP) == nil {
+		return Config{}, fmt.Errorf("PortHostIP must be an IP address, not '%s'", config.PortHostIP)
+	}
+
+	_, err = container.JsonFileLogConfig(config.LogMaxSize, config.LogMaxFile)
+	if err != nil {
+		return Config{}, err
+	}
+
 	log.SetOutput(os.Stdout)
 	if config.Debug {
 		log.SetLevel(log.DebugLevel)
@@ -255,7 +563,40 @@ func initConfig() (Config, error) {
 	return config, nil
 }
 
+// parseFlags handles the command line. Mesos starts us via executor.sh, which
+// passes -logtostderr, so we accept that and ignore it. Returns the ID of the
+// container to attach to, if we were asked to.
+func parseFlags(args []string) (string, error) {
+	flags := flag.NewFlagSet("sidecar-executor", flag.ContinueOnError)
+	flags.Bool("logtostderr", true, "Ignored, for compatibility with executor.sh")
+	attachId := flags.String("attach", "",
+		"Watch an already running container by ID, without talking to Mesos")
+
+	err := flags.Parse(args)
+	return *attachId, err
+}
+
+// newDockerClient connects to Docker as configured in the environment. The
+// client normally uses the daemon's default API version, which can break
+// against older daemons, so the version may be pinned.
+func newDockerClient(apiVersion string) (*docker.Client, error) {
+	if apiVersion == "" {
+		return docker.NewClientFromEnv()
+	}
+
+	log.Infof("Using Docker API version %s", apiVersion)
+	return docker.NewVersionedClientFromEnv(apiVersion)
+}
+
 func main() {
+	attachId, err := parseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2) // The flag package has already told the user
+	}
+
+	// Each executor needs its own jitter on the health checks
+	rand.Seed(time.Now().UnixNano())
+
 	log.Info("Starting Sidecar Executor")
 	config, err := initConfig()
 	if err != nil {
@@ -263,15 +604,38 @@ func main() {
 	}
 
 	logConfig(config)
+	logConfigSummary(config)
 
 	// Get a Docker client. Without one, we can't do anything.
-	dockerClient, err := docker.NewClientFromEnv()
+	dockerClient, err := newDockerClient(config.DockerApiVersion)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
 	dockerAuth := getDockerAuthConfig(config.DockerRepository)
-	scExec := newSidecarExecutor(dockerClient, &dockerAuth, config)
+	scExec := newSidecarExecutor(
+		container.NewBreakerClient(dockerClient, config.DockerTimeout, config.DockerMaxFailures),
+		&dockerAuth, config,
+	)
+
+	if config.HealthAddr != "" {
+		go scExec.serveHealth(config.HealthAddr)
+	}
+
+	// Debugging mode: watch a container we didn't start, with no Mesos
+	if attachId != "" {
+		scExec.driver = newAttachDriver()
+		go handleSignals(scExec)
+
+		err = scExec.attachContainer(attachId)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+
+		scExec.driver.Run()
+		log.Info("Sidecar Executor exiting")
+		os.Exit(scExec.processExitCode())
+	}
 
 	// The Mesos lib has its own env configuration, so load that up as well.
 	// This supports all the MESOS_* env vars passed by the agent on startup.
@@ -298,4 +662,5 @@ func main() {
 	time.Sleep(2 * time.Second)
 
 	log.Info("Sidecar Executor exiting")
+	os.Exit(scExec.processExitCode())
 }
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
 
+	docker "github.com/fsouza/go-dockerclient"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -23,3 +26,180 @@ func Test_SetProcessName(t *testing.T) {
 		})
 	})
 }
+
+func Test_parseFlags(t *testing.T) {
+	Convey("parseFlags()", t, func() {
+		Convey("accepts the arguments executor.sh passes", func() {
+			attachId, err := parseFlags([]string{"-logtostderr=true", "     "})
+			So(err, ShouldBeNil)
+			So(attachId, ShouldBeEmpty)
+		})
+
+		Convey("returns the container to attach to", func() {
+			attachId, err := parseFlags([]string{"-attach", "deadbeef0010"})
+			So(err, ShouldBeNil)
+			So(attachId, ShouldEqual, "deadbeef0010")
+		})
+	})
+}
+
+func Test_initConfig(t *testing.T) {
+	Convey("initConfig()", t, func() {
+		Reset(func() {
+			os.Unsetenv("EXECUTOR_RELAY_SYSLOG_STREAMS")
+			os.Unsetenv("EXECUTOR_CGROUP_PARENT")
+			os.Unsetenv("EXECUTOR_RELAY_SYSLOG_WHEN_HEALTHY")
+			os.Unsetenv("EXECUTOR_RELAY_SYSLOG_STARTUP_ONLY")
+			os.Unsetenv("EXECUTOR_ON_UNHEALTHY")
+			os.Unsetenv("EXECUTOR_IMAGE_ALLOWLIST")
+			os.Unsetenv("EXECUTOR_PORT_HOST_IP")
+			os.Unsetenv("EXECUTOR_SIDECAR_SUCCESS_THRESHOLD")
+			os.Unsetenv("EXECUTOR_SIDECAR_ON_UNKNOWN")
+			os.Unsetenv("EXECUTOR_RELAY_STDERR_SEVERITY")
+			os.Unsetenv("EXECUTOR_SIDECAR_SERVICE_PATH")
+			os.Unsetenv("EXECUTOR_DOCKER_ERROR_RETRIES")
+			os.Unsetenv("EXECUTOR_DOCKER_RECONNECT_TIMEOUT")
+		})
+
+		Convey("relays both streams by default", func() {
+			config, err := initConfig()
+			So(err, ShouldBeNil)
+			So(config.RelaySyslogStreams, ShouldEqual, "both")
+		})
+
+		Convey("rejects an unknown stream selection", func() {
+			os.Setenv("EXECUTOR_RELAY_SYSLOG_STREAMS", "stdin")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not 'stdin'")
+		})
+
+		Convey("rejects relaying only when healthy and only at startup", func() {
+			os.Setenv("EXECUTOR_RELAY_SYSLOG_WHEN_HEALTHY", "true")
+			os.Setenv("EXECUTOR_RELAY_SYSLOG_STARTUP_ONLY", "true")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "can't be combined")
+		})
+
+		Convey("rejects an unknown unhealthy action", func() {
+			os.Setenv("EXECUTOR_ON_UNHEALTHY", "restart")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not 'restart'")
+		})
+
+		Convey("rejects a malformed image allowlist pattern", func() {
+			os.Setenv("EXECUTOR_IMAGE_ALLOWLIST", "nitro/*,nitro/[app")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'nitro/[app'")
+		})
+
+		Convey("rejects a port host IP that isn't an IP", func() {
+			os.Setenv("EXECUTOR_PORT_HOST_IP", "eth1")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not 'eth1'")
+		})
+
+		Convey("rejects an unknown action for UNKNOWN statuses", func() {
+			os.Setenv("EXECUTOR_SIDECAR_ON_UNKNOWN", "ignore")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "not 'ignore'")
+		})
+
+		Convey("rejects a service path without the service ID", func() {
+			os.Setenv("EXECUTOR_SIDECAR_SERVICE_PATH", "Servers.{host}.Services")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "must contain '{id}'")
+		})
+
+		Convey("rejects an unknown syslog severity", func() {
+			os.Setenv("EXECUTOR_RELAY_STDERR_SEVERITY", "dire")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "'dire'")
+		})
+
+		Convey("rejects a success threshold below one", func() {
+			os.Setenv("EXECUTOR_SIDECAR_SUCCESS_THRESHOLD", "0")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "at least 1, not 0")
+		})
+
+		Convey("rejects negative Docker error retries", func() {
+			os.Setenv("EXECUTOR_DOCKER_ERROR_RETRIES", "-1")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "can't be negative")
+		})
+
+		Convey("rejects two retry policies for Docker errors", func() {
+			os.Setenv("EXECUTOR_DOCKER_ERROR_RETRIES", "3")
+			os.Setenv("EXECUTOR_DOCKER_RECONNECT_TIMEOUT", "30s")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "can't be combined")
+		})
+
+		Convey("rejects an implausible cgroup parent", func() {
+			os.Setenv("EXECUTOR_CGROUP_PARENT", "/mesos tasks")
+
+			_, err := initConfig()
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Invalid cgroup parent")
+		})
+	})
+}
+
+func Test_newDockerClient(t *testing.T) {
+	Convey("newDockerClient()", t, func() {
+		var paths []string
+		fakeDocker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/version" {
+				w.Write([]byte(`{"ApiVersion":"1.40"}`))
+				return
+			}
+
+			paths = append(paths, r.URL.Path)
+			w.Write([]byte(`[]`))
+		}))
+		defer fakeDocker.Close()
+
+		os.Setenv("DOCKER_HOST", strings.Replace(fakeDocker.URL, "http://", "tcp://", 1))
+		defer os.Unsetenv("DOCKER_HOST")
+
+		Convey("uses the pinned API version", func() {
+			client, err := newDockerClient("1.24")
+			So(err, ShouldBeNil)
+
+			_, err = client.ListContainers(docker.ListContainersOptions{})
+			So(err, ShouldBeNil)
+			So(paths, ShouldContain, "/v1.24/containers/json")
+		})
+
+		Convey("leaves the version alone when it's not pinned", func() {
+			client, err := newDockerClient("")
+			So(err, ShouldBeNil)
+
+			_, err = client.ListContainers(docker.ListContainersOptions{})
+			So(err, ShouldBeNil)
+			So(paths, ShouldContain, "/containers/json")
+		})
+	})
+}
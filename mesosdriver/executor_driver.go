@@ -8,6 +8,7 @@ import (
 	"net/url"
 	"time"
 
+	"github.com/Nitro/sidecar-executor/loghooks"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
 	"github.com/mesos/mesos-go/api/v1/lib/backoff"
 	"github.com/mesos/mesos-go/api/v1/lib/encoding"
@@ -27,10 +28,12 @@ const (
 	driverHttpTimeout = 10 * time.Second
 )
 
-// A TaskDelegate is responsible for launching and killing tasks
+// A TaskDelegate is responsible for launching and killing tasks, and for
+// handling any messages the framework sends to the executor.
 type TaskDelegate interface {
 	LaunchTask(taskInfo *mesos.TaskInfo)
 	KillTask(taskID *mesos.TaskID)
+	FrameworkMessage(data []byte)
 }
 
 // The ExecutorDriver does all the work of interacting with Mesos and the Agent
@@ -158,6 +161,7 @@ func (driver *ExecutorDriver) buildEventHandler() events.Handler {
 
 		executor.Event_MESSAGE: func(_ context.Context, e *executor.Event) error {
 			log.Debugf("MESSAGE: received %d bytes of message data", len(e.Message.Data))
+			driver.delegate.FrameworkMessage(e.Message.Data)
 			return nil
 		},
 
@@ -280,7 +284,16 @@ func (driver *ExecutorDriver) Run() error {
 	disconnectTime := time.Now()
 	handler := driver.buildEventHandler()
 
+	var resubscribes int
 	for {
+		// Updates the agent never acknowledged are sent again when we
+		// resubscribe
+		if n := len(driver.unackedUpdates); n > 0 && resubscribes > 0 {
+			loghooks.LogRetry("status-ack", resubscribes, 0, 0,
+				fmt.Errorf("%d status updates not acknowledged", n))
+		}
+		resubscribes += 1
+
 		// Function block to ensure response is closed
 		func() {
 			subscribe := calls.Subscribe(
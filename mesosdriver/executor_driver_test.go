@@ -13,6 +13,7 @@ type MockDelegate struct{}
 
 func (m *MockDelegate) LaunchTask(taskInfo *mesos.TaskInfo) {}
 func (m *MockDelegate) KillTask(taskID *mesos.TaskID)       {}
+func (m *MockDelegate) FrameworkMessage(data []byte)        {}
 
 func Test_NewExecutorDriver(t *testing.T) {
 	Convey("NewExecutorDriver()", t, func() {
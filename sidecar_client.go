@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nitro/sidecar-executor/loghooks"
+	"github.com/Nitro/sidecar/service"
+	log "github.com/sirupsen/logrus"
+)
+
+// The layout of the Sidecar state that SidecarServices describes
+const defaultSidecarServicePath = "Servers.{host}.Services.{id}"
+
+var (
+	errSidecarUnreachable = errors.New("Can't contact Sidecar")
+	errServiceNotFound    = errors.New("Service not found in Sidecar")
+)
+
+// SidecarClient asks Sidecar how healthy our service is. The status is one of
+// the Sidecar service statuses, e.g. service.ALIVE or service.UNHEALTHY. When
+// Sidecar can't be reached, the error wraps errSidecarUnreachable, and when it
+// doesn't know about the service, errServiceNotFound.
+type SidecarClient interface {
+	CheckServiceHealth(containerId string, hostname string) (int, error)
+}
+
+// httpSidecarClient fetches the whole state from Sidecar over HTTP, with
+// retries, and looks our service up in it.
+type httpSidecarClient struct {
+	fetcher SidecarFetcher
+	config  Config
+	// Don't warn about each failed attempt, because Sidecar has been down
+	// for a while and we're throttling the logs.
+	quiet bool
+	// Where we keep the last state we fetched, if anywhere
+	cache *sidecarStateCache
+}
+
+// sidecarStateCache keeps the last state we fetched from Sidecar, and what we
+// made of it, so the debug endpoint can show why we decided what we did.
+type sidecarStateCache struct {
+	lock       sync.Mutex
+	fetchedAt  time.Time
+	body       []byte
+	services   *SidecarServices
+	parseError string
+}
+
+func (c *sidecarStateCache) store(body []byte, services SidecarServices, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.fetchedAt = time.Now()
+	c.body = body
+	c.services = &services
+	c.parseError = ""
+
+	if err != nil {
+		c.services = nil
+		c.parseError = err.Error()
+	}
+}
+
+func (c *httpSidecarClient) CheckServiceHealth(containerId string, hostname string) (int, error) {
+	stateUrl, err := sidecarStateUrl(c.config)
+	if err != nil {
+		return service.UNKNOWN, err
+	}
+
+	fetch := func() ([]byte, error) {
+		resp, err := c.fetcher.Get(stateUrl)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		// An empty body is a Sidecar that isn't ready to answer, not bad JSON,
+		// so it's worth trying again
+		if len(bytes.TrimSpace(body)) == 0 {
+			return nil, errors.New("Empty response from Sidecar")
+		}
+
+		return body, nil
+	}
+
+	// Try to connect to Sidecar, with some retries
+	var data []byte
+	for i := 0; i <= c.config.SidecarRetryCount; i++ {
+		data, err = fetch()
+		if err == nil || i == c.config.SidecarRetryCount {
+			break
+		}
+
+		if !c.quiet {
+			loghooks.LogRetry("sidecar", i+1, c.config.SidecarRetryCount+1, c.config.SidecarRetryDelay, err)
+		}
+		time.Sleep(c.config.SidecarRetryDelay)
+	}
+
+	if err != nil {
+		return service.UNKNOWN, fmt.Errorf("%w: %s", errSidecarUnreachable, err)
+	}
+
+	// We got a successful result from Sidecar, so let's parse it!
+	services, err := parseSidecarState(data)
+	if c.cache != nil {
+		c.cache.store(data, services, err)
+	}
+
+	var svc *service.Service
+	var ok bool
+	if c.config.SidecarServicePath != "" && c.config.SidecarServicePath != defaultSidecarServicePath {
+		// Other layouts needn't decode as SidecarServices at all
+		svc, ok, err = sidecarPathLookup(data, c.config.SidecarServicePath,
+			sidecarHostname(hostname), sidecarServiceId(containerId, c.config.SidecarIdLength))
+	} else if err == nil {
+		svc, ok = sidecarLookup(containerId, sidecarHostname(hostname), c.config.SidecarIdLength, services)
+	}
+	if err != nil {
+		return service.UNKNOWN, fmt.Errorf("Can't parse Sidecar results: %s", err)
+	}
+	if !ok {
+		return service.UNKNOWN, errServiceNotFound
+	}
+
+	return svc.Status, nil
+}
+
+// sidecarStateUrl composes the URL for the Sidecar state from the base URL and
+// the state path. Because the path is absolute, older configs that put the
+// whole URL in SidecarUrl continue to work.
+func sidecarStateUrl(config Config) (string, error) {
+	base, err := url.Parse(config.SidecarUrl)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Sidecar URL: %s", err)
+	}
+
+	path, err := url.Parse(config.SidecarStatePath)
+	if err != nil {
+		return "", fmt.Errorf("Unable to parse Sidecar state path: %s", err)
+	}
+
+	return base.ResolveReference(path).String(), nil
+}
+
+// sidecarHostname strips any scheme and port from the host we were given in
+// TASK_HOST, which is sometimes set to host:port or a URL. Sidecar keys its
+// servers by the bare hostname.
+func sidecarHostname(taskHost string) string {
+	host := strings.TrimSpace(taskHost)
+
+	if strings.Contains(host, "://") {
+		if parsed, err := url.Parse(host); err == nil && parsed.Hostname() != "" {
+			return parsed.Hostname()
+		}
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Lookup a container in a service list
+func sidecarLookup(containerId string, hostname string, idLength int, services SidecarServices) (*service.Service, bool) {
+	if _, ok := services.Servers[hostname]; !ok {
+		// Don't even have this host!
+		log.Warnf("Host not found in Sidecar, can't manage this container! (%s)", hostname)
+		return nil, ok
+	}
+
+	svc, ok := services.Servers[hostname].Services[sidecarServiceId(containerId, idLength)]
+
+	return &svc, ok
+}
+
+// sidecarPathLookup finds a service in the raw Sidecar state by following
+// path, a dot-separated list of keys in which {host} and {id} stand for the
+// hostname and service ID. This lets us handle Sidecar versions that don't
+// nest their services the way SidecarServices expects.
+func sidecarPathLookup(data []byte, path string, hostname string, serviceId string) (*service.Service, bool, error) {
+	raw := json.RawMessage(data)
+
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	for _, key := range strings.Split(path, ".") {
+		key = strings.NewReplacer("{host}", hostname, "{id}", serviceId).Replace(key)
+
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, false, fmt.Errorf("expected an object before '%s' in '%s': %s", key, path, err)
+		}
+
+		var ok bool
+		raw, ok = object[key]
+		if !ok {
+			log.Debugf("Key '%s' not found in Sidecar state, following '%s'", key, path)
+			return nil, false, nil
+		}
+	}
+
+	var svc service.Service
+	if err := json.Unmarshal(raw, &svc); err != nil {
+		return nil, false, fmt.Errorf("entry at '%s' isn't a service: %s", path, err)
+	}
+
+	return &svc, true, nil
+}
+
+// parseSidecarState decodes the state returned from Sidecar. We log what we
+// found because a change in the format would otherwise silently produce an
+// empty state, and the service would never be found.
+func parseSidecarState(data []byte) (SidecarServices, error) {
+	var services SidecarServices
+	err := json.Unmarshal(data, &services)
+	if err != nil {
+		return services, err
+	}
+
+	var serviceCount int
+	for _, server := range services.Servers {
+		serviceCount += len(server.Services)
+	}
+
+	log.Debugf("Parsed Sidecar state: %d servers, %d services", len(services.Servers), serviceCount)
+
+	return services, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"github.com/Nitro/sidecar/service"
+	log "github.com/sirupsen/logrus"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_httpSidecarClient(t *testing.T) {
+	Convey("httpSidecarClient", t, func() {
+		log.SetOutput(ioutil.Discard)
+		fetcher := &mockFetcher{}
+
+		client := &httpSidecarClient{
+			fetcher: fetcher,
+			config: Config{
+				SidecarUrl:       "http://localhost:7777",
+				SidecarStatePath: "/state.json",
+				SidecarIdLength:  12,
+			},
+		}
+
+		Convey("returns the status of the service", func() {
+			status, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, service.ALIVE)
+			So(fetcher.lastUrl, ShouldEqual, "http://localhost:7777/state.json")
+		})
+
+		Convey("finds the service when the host has a port or scheme", func() {
+			status, err := client.CheckServiceHealth("deadbeef0010", "http://roncevalles:7777")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, service.ALIVE)
+		})
+
+		Convey("follows a configured service path", func() {
+			client.config.SidecarServicePath = "$.Servers.{host}.Services.{id}"
+
+			status, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, service.ALIVE)
+
+			_, err = client.CheckServiceHealth("deadbeef0010", "heorot")
+			So(err, ShouldEqual, errServiceNotFound)
+		})
+
+		Convey("returns unhealthy services", func() {
+			fetcher.ShouldFail = true
+
+			status, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(err, ShouldBeNil)
+			So(status, ShouldEqual, service.TOMBSTONE)
+		})
+
+		Convey("retries, then reports Sidecar as unreachable", func() {
+			fetcher.ShouldError = true
+			client.config.SidecarRetryCount = 2
+
+			_, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(errors.Is(err, errSidecarUnreachable), ShouldBeTrue)
+			So(fetcher.callCount, ShouldEqual, 3)
+		})
+
+		Convey("reports services that aren't found", func() {
+			_, err := client.CheckServiceHealth("deadbeef0010", "heorot")
+			So(err, ShouldEqual, errServiceNotFound)
+
+			_, err = client.CheckServiceHealth("undiscovered", "roncevalles")
+			So(err, ShouldEqual, errServiceNotFound)
+		})
+
+		Convey("retries empty responses, then reports Sidecar as unreachable", func() {
+			fetcher.ShouldBeEmpty = true
+			client.config.SidecarRetryCount = 2
+
+			_, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(errors.Is(err, errSidecarUnreachable), ShouldBeTrue)
+			So(err.Error(), ShouldContainSubstring, "Empty response from Sidecar")
+			So(fetcher.callCount, ShouldEqual, 3)
+		})
+
+		Convey("returns an error on bad JSON", func() {
+			fetcher.ShouldBadJson = true
+
+			_, err := client.CheckServiceHealth("deadbeef0010", "roncevalles")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "Can't parse Sidecar results")
+			So(errors.Is(err, errSidecarUnreachable), ShouldBeFalse)
+		})
+	})
+}
+
+func Test_sidecarPathLookup(t *testing.T) {
+	Convey("sidecarPathLookup()", t, func() {
+		log.SetOutput(ioutil.Discard)
+
+		// A layout that wouldn't decode as SidecarServices
+		state := []byte(`
+			{
+				"Servers": ["roncevalles"],
+				"Hosts": {
+					"roncevalles": {
+						"Services": {
+							"deadbeef0010": { "ID": "deadbeef0010", "Name": "beowulf", "Status": 2 }
+						}
+					}
+				}
+			}
+		`)
+
+		Convey("finds the service in a non-default layout", func() {
+			svc, ok, err := sidecarPathLookup(state, "$.Hosts.{host}.Services.{id}", "roncevalles", "deadbeef0010")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			So(svc.Name, ShouldEqual, "beowulf")
+			So(svc.Status, ShouldEqual, service.UNHEALTHY)
+		})
+
+		Convey("reports services that aren't there", func() {
+			_, ok, err := sidecarPathLookup(state, "Hosts.{host}.Services.{id}", "heorot", "deadbeef0010")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+
+			_, ok, err = sidecarPathLookup(state, "Hosts.{host}.Services.{id}", "roncevalles", "undiscovered")
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("returns an error when the path runs into something else", func() {
+			_, _, err := sidecarPathLookup(state, "Servers.{host}.{id}", "roncevalles", "deadbeef0010")
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "expected an object")
+		})
+	})
+}
+
+func Test_sidecarHostname(t *testing.T) {
+	Convey("sidecarHostname()", t, func() {
+		Convey("leaves a bare hostname alone", func() {
+			So(sidecarHostname("roncevalles"), ShouldEqual, "roncevalles")
+		})
+
+		Convey("strips the port", func() {
+			So(sidecarHostname("roncevalles:5051"), ShouldEqual, "roncevalles")
+			So(sidecarHostname("[fe80::1]:5051"), ShouldEqual, "fe80::1")
+		})
+
+		Convey("strips the scheme, port, and path from a URL", func() {
+			So(sidecarHostname("http://roncevalles"), ShouldEqual, "roncevalles")
+			So(sidecarHostname("https://roncevalles:5051/state"), ShouldEqual, "roncevalles")
+		})
+
+		Convey("leaves IPv6 addresses without a port intact", func() {
+			So(sidecarHostname("fe80::1"), ShouldEqual, "fe80::1")
+		})
+	})
+}